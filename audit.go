@@ -0,0 +1,226 @@
+/*
+ * Audit log
+ *
+ * Copyright (C) 2024  Runxi Yu <https://runxiyu.org>
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+/*
+ * Actions recorded in the audit log
+ */
+const (
+	auditChoose         = "choose"
+	auditUnchoose       = "unchoose"
+	auditConfirm        = "confirm"
+	auditUnconfirm      = "unconfirm"
+	auditWait           = "wait"
+	auditUnwait         = "unwait"
+	auditPromote        = "promote"
+	auditPreferences    = "preferences"
+	auditLottery        = "lottery"
+	auditImport         = "import"
+	auditRoster         = "roster"
+	auditState          = "state"
+	auditForceChoose    = "force choose"
+	auditForceRemove    = "force remove"
+	auditCourseAdd      = "add course"
+	auditCourseEdit     = "edit course"
+	auditCourseRetire   = "retire course"
+	auditTokenCreate    = "create token"
+	auditTokenRevoke    = "revoke token"
+	auditSessionsRevoke = "revoke sessions"
+)
+
+const auditAccepted = "accepted"
+
+/*
+ * Actors that are not users
+ */
+const (
+	auditActorWaitlist = "waitlist"
+	auditActorSchedule = "schedule"
+)
+
+type auditT struct {
+	Time     time.Time
+	UserID   string /* the affected student; empty if none */
+	Actor    string /* the user ID of whoever performed the action, or one of the non-user actors */
+	Action   string
+	CourseID int    /* zero if none */
+	Outcome  string /* auditAccepted, or the reason for rejection */
+	Conn     string /* the WebSocket connection ID, if any */
+	Note     string
+}
+
+/*
+ * Append an entry to the audit log. The time is always the current time.
+ * The querier should be the transaction that performs the action, if any.
+ */
+func recordAudit(ctx context.Context, q dbQuerier, entry auditT) error {
+	_, err := q.Exec(
+		ctx,
+		"INSERT INTO audit (time, userid, actor, action, courseid, outcome, conn, note) VALUES ($1, NULLIF($2, ''), $3, $4, NULLIF($5, 0), $6, $7, $8)",
+		time.Now().UnixMicro(),
+		entry.UserID,
+		entry.Actor,
+		entry.Action,
+		entry.CourseID,
+		entry.Outcome,
+		entry.Conn,
+		entry.Note,
+	)
+	if err != nil {
+		return wrapError(errUnexpectedDBError, err)
+	}
+	return nil
+}
+
+/*
+ * Execute a statement that performs an accepted action, and record it in the
+ * audit log in the same transaction, so that neither happens without the
+ * other.
+ */
+func execAudited(ctx context.Context, entry auditT, sql string, args ...any) (retErr error) {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return wrapError(errUnexpectedDBError, err)
+	}
+	defer func() {
+		err := tx.Rollback(ctx)
+		if err != nil && (!errors.Is(err, pgx.ErrTxClosed)) {
+			retErr = wrapError(errUnexpectedDBError, err)
+			return
+		}
+	}()
+
+	_, err = tx.Exec(ctx, sql, args...)
+	if err != nil {
+		return wrapError(errUnexpectedDBError, err)
+	}
+
+	entry.Outcome = auditAccepted
+	err = recordAudit(ctx, tx, entry)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return wrapError(errUnexpectedDBError, err)
+	}
+	return nil
+}
+
+/*
+ * Record an action that was rejected. Nothing was changed, so unlike accepted
+ * actions, it is not recorded in the transaction that attempted it, which has
+ * been rolled back.
+ */
+func recordRejection(ctx context.Context, entry auditT, reason string) error {
+	entry.Outcome = reason
+	return recordAudit(ctx, db, entry)
+}
+
+type auditRowT struct {
+	auditT
+	UserName    string
+	UserEmail   string
+	StudentID   string
+	ActorName   string
+	CourseTitle string
+}
+
+/*
+ * This is used in templates, where course IDs of zero should be blank.
+ */
+func (row auditRowT) CourseIDString() string {
+	if row.CourseID == 0 {
+		return ""
+	}
+	return strconv.Itoa(row.CourseID)
+}
+
+/*
+ * Search the audit log, the latest first. The student filter matches the
+ * student's user ID exactly, or their name or email partially; the course
+ * filter matches the course's ID exactly, or its title partially. Empty
+ * filters match everything. A limit of zero means no limit.
+ */
+func searchAudit(
+	ctx context.Context,
+	student string,
+	course string,
+	limit int,
+) ([]auditRowT, error) {
+	rows, err := db.Query(
+		ctx,
+		`SELECT a.time, COALESCE(a.userid, ''), a.actor, a.action, COALESCE(a.courseid, 0), a.outcome, a.conn, a.note,
+			COALESCE(u.name, ''), COALESCE(u.email, ''), COALESCE(u.student_id, ''), COALESCE(actor.name, a.actor), COALESCE(c.title, '')
+		FROM audit a
+		LEFT JOIN users u ON u.id = a.userid
+		LEFT JOIN users actor ON actor.id = a.actor
+		LEFT JOIN courses c ON c.id = a.courseid
+		WHERE ($1 = '' OR a.userid = $1 OR u.name ILIKE '%' || $1 || '%' OR u.email ILIKE '%' || $1 || '%')
+		AND ($2 = '' OR a.courseid::TEXT = $2 OR c.title ILIKE '%' || $2 || '%')
+		ORDER BY a.id DESC
+		LIMIT NULLIF($3, 0)`,
+		student,
+		course,
+		limit,
+	)
+	if err != nil {
+		return nil, wrapError(errUnexpectedDBError, err)
+	}
+	entries, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (auditRowT, error) {
+		var entry auditRowT
+		var unixTime int64
+		err := row.Scan(
+			&unixTime,
+			&entry.UserID,
+			&entry.Actor,
+			&entry.Action,
+			&entry.CourseID,
+			&entry.Outcome,
+			&entry.Conn,
+			&entry.Note,
+			&entry.UserName,
+			&entry.UserEmail,
+			&entry.StudentID,
+			&entry.ActorName,
+			&entry.CourseTitle,
+		)
+		entry.Time = time.UnixMicro(unixTime)
+		if entry.UserEmail != "" {
+			entry.StudentID = studentIDOf(entry.StudentID, entry.UserEmail)
+		}
+		return entry, err
+	})
+	if err != nil {
+		return nil, wrapError(errUnexpectedDBError, err)
+	}
+	return entries, nil
+}
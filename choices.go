@@ -0,0 +1,422 @@
+/*
+ * Choosing and unchoosing courses
+ *
+ * Copyright (C) 2024  Runxi Yu <https://runxiyu.org>
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+/*
+ * Lock the user's row until the transaction ends, so that changes to one
+ * user's choices from different places (e.g. their own connection and a
+ * waitlist promotion) are sequentialized, and report whether they have
+ * confirmed their choices. Confirmed choices must not be changed by the
+ * student; anyone else changing them must unconfirm them first.
+ */
+func lockUser(ctx context.Context, tx pgx.Tx, userID string) (confirmed bool, retErr error) {
+	err := tx.QueryRow(
+		ctx,
+		"SELECT confirmed FROM users WHERE id = $1 FOR UPDATE",
+		userID,
+	).Scan(&confirmed)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return false, errNoSuchUser
+		}
+		return false, wrapError(errUnexpectedDBError, err)
+	}
+	return confirmed, nil
+}
+
+/*
+ * Check whether the user may choose the course, and insert the choice within
+ * the transaction if so. The user's row is locked until the transaction ends.
+ * The returned reason is empty if the choice was inserted, or if it already
+ * existed, in which case inserted is false. This does not touch
+ * course.Selected; the caller is responsible for reserving a seat, with the
+ * same details of the course that the checks were made with.
+ */
+func insertChoice(
+	ctx context.Context,
+	tx pgx.Tx,
+	userID string,
+	department string,
+	course *courseT,
+	info *courseInfoT,
+) (reason string, inserted bool, retErr error) {
+	confirmed, err := lockUser(ctx, tx, userID)
+	if err != nil {
+		return "", false, err
+	}
+
+	var alreadyChosen bool
+	err = tx.QueryRow(
+		ctx,
+		"SELECT EXISTS (SELECT 1 FROM choices WHERE userid = $1 AND courseid = $2)",
+		userID,
+		course.ID,
+	).Scan(&alreadyChosen)
+	if err != nil {
+		return "", false, wrapError(errUnexpectedDBError, err)
+	}
+	if alreadyChosen {
+		return "", false, nil
+	}
+
+	if confirmed {
+		return "Confirmed", false, nil
+	}
+
+	if !info.EligibleFor(department) {
+		return "Not eligible", false, nil
+	}
+
+	var userCourseGroups userCourseGroupsT = make(map[string]struct{})
+	var userCourseTypes userCourseTypesT = make(map[string]int)
+	err = populateUserCourseTypesAndGroups(
+		ctx,
+		tx,
+		&userCourseTypes,
+		&userCourseGroups,
+		userID,
+	)
+	if err != nil {
+		return "", false, err
+	}
+
+	if _, ok := userCourseGroups[info.Group]; ok {
+		return "Group conflict", false, nil
+	}
+
+	requirement, err := getCourseTypeRequirementForYearGroup(department, info.Type)
+	if err != nil {
+		return "", false, wrapError(errInvalidYearGroupOrCourseType, err)
+	}
+	if requirement.Max >= 0 && userCourseTypes[info.Type] >= requirement.Max {
+		return "Too many " + info.Type, false, nil
+	}
+
+	maxChoices, err := getMaxChoicesForYearGroup(department)
+	if err != nil {
+		return "", false, wrapError(errInvalidYearGroupOrCourseType, err)
+	}
+	if maxChoices >= 0 && userCourseTypes.total() >= maxChoices {
+		return "Too many choices", false, nil
+	}
+
+	_, err = tx.Exec(
+		ctx,
+		"INSERT INTO choices (seltime, userid, courseid) VALUES ($1, $2, $3)",
+		time.Now().UnixMicro(),
+		userID,
+		course.ID,
+	)
+	if err != nil {
+		return "", false, wrapError(errUnexpectedDBError, err)
+	}
+
+	/* Choosing a course implies leaving its waitlist. */
+	_, err = tx.Exec(
+		ctx,
+		"DELETE FROM waitlist WHERE userid = $1 AND courseid = $2",
+		userID,
+		course.ID,
+	)
+	if err != nil {
+		return "", false, wrapError(errUnexpectedDBError, err)
+	}
+
+	return "", true, nil
+}
+
+/*
+ * Choose a course for the user, performing the same checks regardless of who
+ * initiated it. The returned reason is empty if the course is now chosen, and
+ * otherwise explains why it was rejected. The audit entry is recorded in the
+ * same transaction if the course is chosen.
+ */
+func chooseCourse(
+	ctx context.Context,
+	userID string,
+	department string,
+	course *courseT,
+	entry auditT,
+) (reason string, retErr error) {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return "", wrapError(errUnexpectedDBError, err)
+	}
+	defer func() {
+		err := tx.Rollback(ctx)
+		if err != nil && (!errors.Is(err, pgx.ErrTxClosed)) {
+			retErr = wrapError(errUnexpectedDBError, err)
+			return
+		}
+	}()
+
+	info := course.Info()
+	reason, inserted, err := insertChoice(ctx, tx, userID, department, course, info)
+	if err != nil || reason != "" || !inserted {
+		return reason, err
+	}
+
+	entry.Outcome = auditAccepted
+	err = recordAudit(ctx, tx, entry)
+	if err != nil {
+		return "", err
+	}
+
+	reason = course.acquireSeat(info)
+	if reason != "" {
+		return reason, nil
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		err2 := course.releaseSeat(ctx)
+		return "", wrapError(errUnexpectedDBError, errors.Join(err, err2))
+	}
+	go func() {
+		defer func() {
+			if e := recover(); e != nil {
+				slog.Error("panic", "arg", e)
+			}
+		}()
+		propagateSelectedUpdate(course)
+	}()
+
+	return "", nil
+}
+
+/*
+ * Remove a course from the user's choices. The returned reason is empty if
+ * the course was removed, and otherwise explains why it was not. The audit
+ * entry is recorded in the same transaction if the course is removed.
+ */
+func unchooseCourse(
+	ctx context.Context,
+	userID string,
+	course *courseT,
+	entry auditT,
+) (reason string, retErr error) {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return "", wrapError(errUnexpectedDBError, err)
+	}
+	defer func() {
+		err := tx.Rollback(ctx)
+		if err != nil && (!errors.Is(err, pgx.ErrTxClosed)) {
+			retErr = wrapError(errUnexpectedDBError, err)
+			return
+		}
+	}()
+
+	confirmed, err := lockUser(ctx, tx, userID)
+	if err != nil {
+		return "", err
+	}
+	if confirmed {
+		return "Confirmed", nil
+	}
+
+	ct, err := tx.Exec(
+		ctx,
+		"DELETE FROM choices WHERE userid = $1 AND courseid = $2",
+		userID,
+		course.ID,
+	)
+	if err != nil {
+		return "", wrapError(errUnexpectedDBError, err)
+	}
+	if ct.RowsAffected() == 0 {
+		return "Not chosen", nil
+	}
+
+	entry.Outcome = auditAccepted
+	err = recordAudit(ctx, tx, entry)
+	if err != nil {
+		return "", err
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return "", wrapError(errUnexpectedDBError, err)
+	}
+	return "", course.releaseSeat(ctx)
+}
+
+/*
+ * Add a course to the user's choices on behalf of staff, unconfirming their
+ * choices if necessary. The usual checks apply, except that the course may
+ * be filled beyond its maximum if exceed is true. The returned reason is
+ * empty if the course is now chosen, and otherwise explains why it was
+ * rejected.
+ */
+func forceChooseCourse(
+	ctx context.Context,
+	userID string,
+	department string,
+	course *courseT,
+	exceed bool,
+	actor string,
+	note string,
+) (reason string, retErr error) {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return "", wrapError(errUnexpectedDBError, err)
+	}
+	defer func() {
+		err := tx.Rollback(ctx)
+		if err != nil && (!errors.Is(err, pgx.ErrTxClosed)) {
+			retErr = wrapError(errUnexpectedDBError, err)
+			return
+		}
+	}()
+
+	wasConfirmed, err := unconfirmForChange(ctx, tx, userID, actor, note)
+	if err != nil {
+		return "", err
+	}
+
+	info := course.Info()
+	reason, inserted, err := insertChoice(ctx, tx, userID, department, course, info)
+	if err != nil || reason != "" {
+		return reason, err
+	}
+	if !inserted {
+		return "Already chosen", nil
+	}
+
+	err = recordAudit(ctx, tx, auditT{
+		UserID:   userID,
+		Actor:    actor,
+		Action:   auditForceChoose,
+		CourseID: course.ID,
+		Outcome:  auditAccepted,
+		Note:     note,
+	}) //exhaustruct:ignore
+	if err != nil {
+		return "", err
+	}
+
+	if exceed {
+		reason = course.forceSeat(info)
+	} else {
+		reason = course.acquireSeat(info)
+	}
+	if reason != "" {
+		return reason, nil
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		err2 := course.releaseSeat(ctx)
+		return "", wrapError(errUnexpectedDBError, errors.Join(err, err2))
+	}
+
+	sendToUser(userID, fmt.Sprintf("Y %d", course.ID))
+	if wasConfirmed {
+		notifyUnconfirmed(userID)
+	}
+	go func() {
+		defer func() {
+			if e := recover(); e != nil {
+				slog.Error("panic", "arg", e)
+			}
+		}()
+		propagateSelectedUpdate(course)
+	}()
+
+	return "", nil
+}
+
+/*
+ * Remove a course from the user's choices on behalf of staff, unconfirming
+ * their choices if necessary. The returned reason is empty if the course was
+ * removed, and otherwise explains why it was not.
+ */
+func forceUnchooseCourse(
+	ctx context.Context,
+	userID string,
+	course *courseT,
+	actor string,
+	note string,
+) (reason string, retErr error) {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return "", wrapError(errUnexpectedDBError, err)
+	}
+	defer func() {
+		err := tx.Rollback(ctx)
+		if err != nil && (!errors.Is(err, pgx.ErrTxClosed)) {
+			retErr = wrapError(errUnexpectedDBError, err)
+			return
+		}
+	}()
+
+	wasConfirmed, err := unconfirmForChange(ctx, tx, userID, actor, note)
+	if err != nil {
+		return "", err
+	}
+
+	ct, err := tx.Exec(
+		ctx,
+		"DELETE FROM choices WHERE userid = $1 AND courseid = $2",
+		userID,
+		course.ID,
+	)
+	if err != nil {
+		return "", wrapError(errUnexpectedDBError, err)
+	}
+	if ct.RowsAffected() == 0 {
+		return "Not chosen", nil
+	}
+
+	err = recordAudit(ctx, tx, auditT{
+		UserID:   userID,
+		Actor:    actor,
+		Action:   auditForceRemove,
+		CourseID: course.ID,
+		Outcome:  auditAccepted,
+		Note:     note,
+	}) //exhaustruct:ignore
+	if err != nil {
+		return "", err
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return "", wrapError(errUnexpectedDBError, err)
+	}
+
+	sendToUser(userID, fmt.Sprintf("N %d", course.ID))
+	if wasConfirmed {
+		notifyUnconfirmed(userID)
+	}
+
+	return "", course.releaseSeat(ctx)
+}
@@ -24,6 +24,8 @@ import (
 	"bufio"
 	"fmt"
 	"os"
+	"regexp"
+	"strings"
 
 	"git.sr.ht/~emersion/go-scfg"
 )
@@ -39,6 +41,7 @@ import (
 var configWithPointers struct {
 	URL    *string `scfg:"url"`
 	Prod   *bool   `scfg:"prod"`
+	Mode   *string `scfg:"mode"`
 	Listen struct {
 		Proto *string `scfg:"proto"`
 		Net   *string `scfg:"net"`
@@ -54,10 +57,19 @@ var configWithPointers struct {
 		Conn *string `scfg:"conn"`
 	} `scfg:"db"`
 	Auth struct {
-		Client      *string            `scfg:"client"`
-		Authorize   *string            `scfg:"authorize"`
-		Jwks        *string            `scfg:"jwks"`
-		Token       *string            `scfg:"token"`
+		Client       *string `scfg:"client"`
+		Issuer       *string `scfg:"issuer"`
+		Authorize    *string `scfg:"authorize"`
+		Jwks         *string `scfg:"jwks"`
+		Token        *string `scfg:"token"`
+		Scope        *string `scfg:"scope"`
+		ResponseType *string `scfg:"response_type"`
+		Claims       struct {
+			ID     *string `scfg:"id"`
+			Name   *string `scfg:"name"`
+			Email  *string `scfg:"email"`
+			Groups *string `scfg:"groups"`
+		} `scfg:"claims"`
 		Expr        *int               `scfg:"expr"`
 		Departments *map[string]string `scfg:"depts"`
 		Udepts      *map[string]string `scfg:"udepts"`
@@ -70,29 +82,33 @@ var configWithPointers struct {
 		UsemDelayShiftBits  *int  `scfg:"usem_delay_shift_bits"`
 		PropagateImmediate  *bool `scfg:"propagate_immediate"`
 	} `scfg:"perf"`
-	Req struct {
-		Y9 struct {
-			Sport    *int `scfg:"sport"`
-			NonSport *int `scfg:"non_sport"`
-		} `scfg:"y9"`
-		Y10 struct {
-			Sport    *int `scfg:"sport"`
-			NonSport *int `scfg:"non_sport"`
-		} `scfg:"y10"`
-		Y11 struct {
-			Sport    *int `scfg:"sport"`
-			NonSport *int `scfg:"non_sport"`
-		} `scfg:"y11"`
-		Y12 struct {
-			Sport    *int `scfg:"sport"`
-			NonSport *int `scfg:"non_sport"`
-		} `scfg:"y12"`
+	Types *struct {
+		Type []struct {
+			Handle string  `scfg:",param"`
+			Name   *string `scfg:"name"`
+			Colour *string `scfg:"colour"`
+		} `scfg:"type"`
+	} `scfg:"types"`
+	Groups *struct {
+		Group []struct {
+			Handle string  `scfg:",param"`
+			Name   *string `scfg:"name"`
+		} `scfg:"group"`
+	} `scfg:"groups"`
+	Req *map[string]struct {
+		Max   *int `scfg:"max"`
+		Types []struct {
+			Name string `scfg:",param"`
+			Min  *int   `scfg:"min"`
+			Max  *int   `scfg:"max"`
+		} `scfg:"type"`
 	} `scfg:"req"`
 }
 
 var config struct {
 	URL    string
 	Prod   bool
+	Mode   string
 	Listen struct {
 		Proto string
 		Net   string
@@ -108,10 +124,19 @@ var config struct {
 		Conn string
 	}
 	Auth struct {
-		Client      string
-		Authorize   string
-		Jwks        string
-		Token       string
+		Client       string
+		Issuer       string
+		Authorize    string
+		Jwks         string
+		Token        string
+		Scope        string
+		ResponseType string
+		Claims       struct {
+			ID     string
+			Name   string
+			Email  string
+			Groups string
+		}
 		Expr        int
 		Departments map[string]string
 		Udepts      map[string]string
@@ -124,26 +149,13 @@ var config struct {
 		UsemDelayShiftBits  int
 		PropagateImmediate  bool
 	}
-	Req struct {
-		Y9 struct {
-			Sport    int
-			NonSport int
-		}
-		Y10 struct {
-			Sport    int
-			NonSport int
-		}
-		Y11 struct {
-			Sport    int
-			NonSport int
-		}
-		Y12 struct {
-			Sport    int
-			NonSport int
-		}
-	}
+	Types  []courseTypeT
+	Groups []courseGroupT
+	Req    map[string]yearGroupRequirementsT
 }
 
+var colourRegexp = regexp.MustCompile(`^#([0-9a-fA-F]{3}|[0-9a-fA-F]{6})$`)
+
 func fetchConfig(path string) (retErr error) {
 	defer func() {
 		if retErr != nil {
@@ -171,6 +183,20 @@ func fetchConfig(path string) (retErr error) {
 	}
 	config.Prod = *(configWithPointers.Prod)
 
+	/* Configurations from before lotteries existed have no mode */
+	config.Mode = selectionModeFCFS
+	if configWithPointers.Mode != nil {
+		config.Mode = *(configWithPointers.Mode)
+	}
+	if config.Mode != selectionModeFCFS && config.Mode != selectionModeLottery {
+		return fmt.Errorf(
+			"%w: mode must be %q or %q",
+			errInvalidConfigValue,
+			selectionModeFCFS,
+			selectionModeLottery,
+		)
+	}
+
 	if configWithPointers.Listen.Proto == nil {
 		return fmt.Errorf("%w: listen.proto", errMissingConfigValue)
 	}
@@ -224,20 +250,59 @@ func fetchConfig(path string) (retErr error) {
 	}
 	config.Auth.Client = *(configWithPointers.Auth.Client)
 
-	if configWithPointers.Auth.Authorize == nil {
-		return fmt.Errorf("%w: auth.authorize", errMissingConfigValue)
+	/*
+	 * The issuer is always required, as ID tokens are checked against it;
+	 * a JSON Web Key Set may well hold the keys of other issuers too. The
+	 * endpoints are found through OpenID Connect discovery when the server
+	 * starts, unless they are set here.
+	 */
+	if configWithPointers.Auth.Issuer == nil || *(configWithPointers.Auth.Issuer) == "" {
+		return fmt.Errorf("%w: auth.issuer", errMissingConfigValue)
+	}
+	config.Auth.Issuer = strings.TrimSuffix(*(configWithPointers.Auth.Issuer), "/")
+
+	if configWithPointers.Auth.Authorize != nil {
+		config.Auth.Authorize = *(configWithPointers.Auth.Authorize)
+	}
+
+	if configWithPointers.Auth.Jwks != nil {
+		config.Auth.Jwks = *(configWithPointers.Auth.Jwks)
+	}
+
+	if configWithPointers.Auth.Token != nil {
+		config.Auth.Token = *(configWithPointers.Auth.Token)
 	}
-	config.Auth.Authorize = *(configWithPointers.Auth.Authorize)
 
-	if configWithPointers.Auth.Jwks == nil {
-		return fmt.Errorf("%w: auth.jwks", errMissingConfigValue)
+	config.Auth.Scope = "openid profile email"
+	if configWithPointers.Auth.Scope != nil {
+		config.Auth.Scope = *(configWithPointers.Auth.Scope)
 	}
-	config.Auth.Jwks = *(configWithPointers.Auth.Jwks)
 
-	if configWithPointers.Auth.Token == nil {
-		return fmt.Errorf("%w: auth.token", errMissingConfigValue)
+	config.Auth.ResponseType = "id_token code"
+	if configWithPointers.Auth.ResponseType != nil {
+		config.Auth.ResponseType = *(configWithPointers.Auth.ResponseType)
+	}
+
+	/* The defaults are the claims used by Microsoft Entra ID */
+	for _, claim := range []struct {
+		name         string
+		value        *string
+		defaultValue string
+		dest         *string
+	}{
+		{"id", configWithPointers.Auth.Claims.ID, "oid", &config.Auth.Claims.ID},
+		{"name", configWithPointers.Auth.Claims.Name, "name", &config.Auth.Claims.Name},
+		{"email", configWithPointers.Auth.Claims.Email, "email", &config.Auth.Claims.Email},
+		{"groups", configWithPointers.Auth.Claims.Groups, "groups", &config.Auth.Claims.Groups},
+	} {
+		*claim.dest = claim.defaultValue
+		if claim.value != nil {
+			if *claim.value == "" {
+				return fmt.Errorf("%w: auth.claims.%s", errInvalidConfigValue, claim.name)
+			}
+			*claim.dest = *claim.value
+		}
 	}
-	config.Auth.Token = *(configWithPointers.Auth.Token)
 
 	if configWithPointers.Auth.Expr == nil {
 		return fmt.Errorf("%w: auth.expr", errMissingConfigValue)
@@ -308,62 +373,132 @@ func fetchConfig(path string) (retErr error) {
 	}
 	config.Perf.PropagateImmediate = *(configWithPointers.Perf.PropagateImmediate)
 
-	if configWithPointers.Req.Y9.Sport == nil {
-		return fmt.Errorf(
-			"%w: req.y9.sport",
-			errMissingConfigValue,
-		)
-	}
-	config.Req.Y9.Sport = *(configWithPointers.Req.Y9.Sport)
-	if configWithPointers.Req.Y9.NonSport == nil {
-		return fmt.Errorf(
-			"%w: req.y9.non_sport",
-			errMissingConfigValue,
-		)
-	}
-	config.Req.Y9.NonSport = *(configWithPointers.Req.Y9.NonSport)
-	if configWithPointers.Req.Y10.Sport == nil {
-		return fmt.Errorf(
-			"%w: req.y10.non_sport",
-			errMissingConfigValue,
-		)
-	}
-	config.Req.Y10.Sport = *(configWithPointers.Req.Y10.Sport)
-	if configWithPointers.Req.Y10.NonSport == nil {
-		return fmt.Errorf(
-			"%w: req.y10.non_sport",
-			errMissingConfigValue,
-		)
+	if configWithPointers.Types == nil || len(configWithPointers.Types.Type) == 0 {
+		return fmt.Errorf("%w: types", errMissingConfigValue)
 	}
-	config.Req.Y10.NonSport = *(configWithPointers.Req.Y10.NonSport)
-	if configWithPointers.Req.Y11.Sport == nil {
-		return fmt.Errorf(
-			"%w: req.y11.sport",
-			errMissingConfigValue,
-		)
-	}
-	config.Req.Y11.Sport = *(configWithPointers.Req.Y11.Sport)
-	if configWithPointers.Req.Y11.NonSport == nil {
-		return fmt.Errorf(
-			"%w: req.y11.non_sport",
-			errMissingConfigValue,
-		)
+	config.Types = make([]courseTypeT, 0, len(configWithPointers.Types.Type))
+	for _, t := range configWithPointers.Types.Type {
+		if checkCourseType(t.Handle) {
+			return fmt.Errorf(
+				"%w: types.type.%s",
+				errDuplicateConfigValue,
+				t.Handle,
+			)
+		}
+		if t.Name == nil {
+			return fmt.Errorf(
+				"%w: types.type.%s.name",
+				errMissingConfigValue,
+				t.Handle,
+			)
+		}
+		if t.Colour == nil {
+			return fmt.Errorf(
+				"%w: types.type.%s.colour",
+				errMissingConfigValue,
+				t.Handle,
+			)
+		}
+		if !colourRegexp.MatchString(*(t.Colour)) {
+			return fmt.Errorf(
+				"%w: types.type.%s.colour must be a hexadecimal colour like #1e90ff",
+				errInvalidConfigValue,
+				t.Handle,
+			)
+		}
+		config.Types = append(config.Types, courseTypeT{
+			Handle: t.Handle,
+			Name:   *(t.Name),
+			Colour: *(t.Colour),
+		})
+	}
+
+	/*
+	 * Course groups are optional in the configuration file. If they are
+	 * absent, they are managed in the database through course imports.
+	 */
+	if configWithPointers.Groups != nil {
+		config.Groups = make([]courseGroupT, 0, len(configWithPointers.Groups.Group))
+		seenGroups := make(map[string]struct{})
+		for _, g := range configWithPointers.Groups.Group {
+			if _, ok := seenGroups[g.Handle]; ok {
+				return fmt.Errorf(
+					"%w: groups.group.%s",
+					errDuplicateConfigValue,
+					g.Handle,
+				)
+			}
+			seenGroups[g.Handle] = struct{}{}
+			if g.Name == nil {
+				return fmt.Errorf(
+					"%w: groups.group.%s.name",
+					errMissingConfigValue,
+					g.Handle,
+				)
+			}
+			config.Groups = append(config.Groups, courseGroupT{
+				Handle: g.Handle,
+				Name:   *(g.Name),
+			})
+		}
 	}
-	config.Req.Y11.NonSport = *(configWithPointers.Req.Y11.NonSport)
-	if configWithPointers.Req.Y12.Sport == nil {
-		return fmt.Errorf(
-			"%w: req.y12.sport",
-			errMissingConfigValue,
-		)
+
+	if configWithPointers.Req == nil {
+		return fmt.Errorf("%w: req", errMissingConfigValue)
 	}
-	config.Req.Y12.Sport = *(configWithPointers.Req.Y12.Sport)
-	if configWithPointers.Req.Y12.NonSport == nil {
-		return fmt.Errorf(
-			"%w: req.y12.non_sport",
-			errMissingConfigValue,
-		)
+	config.Req = make(map[string]yearGroupRequirementsT)
+	for yearGroup, yearGroupWithPointers := range *(configWithPointers.Req) {
+		requirements := yearGroupRequirementsT{
+			Max:   -1,
+			Types: make(map[string]courseTypeRequirementT),
+		}
+		if yearGroupWithPointers.Max != nil {
+			requirements.Max = *(yearGroupWithPointers.Max)
+		}
+		for _, t := range yearGroupWithPointers.Types {
+			if !checkCourseType(t.Name) {
+				return fmt.Errorf(
+					"%w: req.%s.type.%s",
+					errInvalidCourseType,
+					yearGroup,
+					t.Name,
+				)
+			}
+			if _, ok := requirements.Types[t.Name]; ok {
+				return fmt.Errorf(
+					"%w: req.%s.type.%s",
+					errDuplicateConfigValue,
+					yearGroup,
+					t.Name,
+				)
+			}
+			if t.Min == nil {
+				return fmt.Errorf(
+					"%w: req.%s.type.%s.min",
+					errMissingConfigValue,
+					yearGroup,
+					t.Name,
+				)
+			}
+			requirement := courseTypeRequirementT{
+				Min: *(t.Min),
+				Max: -1,
+			}
+			if t.Max != nil {
+				requirement.Max = *(t.Max)
+				if requirement.Max < requirement.Min {
+					return fmt.Errorf(
+						"%w: req.%s.type.%s.max is less than min",
+						errInvalidConfigValue,
+						yearGroup,
+						t.Name,
+					)
+				}
+			}
+			requirements.Types[t.Name] = requirement
+		}
+		config.Req[yearGroup] = requirements
 	}
-	config.Req.Y12.NonSport = *(configWithPointers.Req.Y12.NonSport)
 
 	return nil
 }
@@ -22,6 +22,8 @@ package main
 
 import (
 	"context"
+
+	"github.com/jackc/pgx/v5"
 )
 
 func getConfirmedStatus(ctx context.Context, userID string) (confirmed bool, retErr error) {
@@ -35,3 +37,48 @@ func getConfirmedStatus(ctx context.Context, userID string) (confirmed bool, ret
 	}
 	return
 }
+
+/*
+ * Unconfirm the user's choices within the transaction, because someone other
+ * than the user is about to change them. The returned bool is true if the
+ * user had confirmed their choices, in which case the caller should call
+ * notifyUnconfirmed after committing.
+ */
+func unconfirmForChange(
+	ctx context.Context,
+	tx pgx.Tx,
+	userID string,
+	actor string,
+	note string,
+) (bool, error) {
+	ct, err := tx.Exec(
+		ctx,
+		"UPDATE users SET confirmed = false WHERE id = $1 AND confirmed",
+		userID,
+	)
+	if err != nil {
+		return false, wrapError(errUnexpectedDBError, err)
+	}
+	if ct.RowsAffected() == 0 {
+		return false, nil
+	}
+	err = recordAudit(ctx, tx, auditT{
+		UserID:  userID,
+		Actor:   actor,
+		Action:  auditUnconfirm,
+		Outcome: auditAccepted,
+		Note:    note,
+	}) //exhaustruct:ignore
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+/*
+ * Tell the user, if they are connected, that their choices have been changed
+ * and are no longer confirmed.
+ */
+func notifyUnconfirmed(userID string) {
+	sendToUser(userID, "NC :Your choices have been changed by staff. Please check and confirm them again.")
+}
@@ -0,0 +1,464 @@
+/*
+ * Add, edit and retire individual courses
+ *
+ * Copyright (C) 2024  Runxi Yu <https://runxiyu.org>
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/jackc/pgx/v5"
+)
+
+/*
+ * The editable fields of a course, as submitted by staff.
+ */
+type courseInputT struct {
+	Title        string   `json:"title"`
+	Max          uint32   `json:"max"`
+	Teacher      string   `json:"teacher"`
+	TeacherEmail string   `json:"teacher_email"`
+	Location     string   `json:"location"`
+	Type         string   `json:"type"`
+	Group        string   `json:"group"`
+	CourseID     string   `json:"course_id"`
+	SectionID    string   `json:"section_id"`
+	Eligible     []string `json:"eligible"`
+}
+
+func (input *courseInputT) check() error {
+	if input.Title == "" {
+		return wrapAny(errInvalidCourse, "missing title")
+	}
+	if !checkCourseType(input.Type) {
+		return wrapAny(errInvalidCourseType, input.Type)
+	}
+	if !checkCourseGroup(input.Group) {
+		return wrapAny(errInvalidCourseGroup, input.Group)
+	}
+	if input.Eligible == nil {
+		input.Eligible = []string{}
+	}
+	for _, e := range input.Eligible {
+		if _, ok := config.Req[e]; !ok {
+			return wrapAny(errNoSuchYearGroup, e)
+		}
+	}
+	return nil
+}
+
+func (input *courseInputT) EligibleString() string {
+	return strings.Join(input.Eligible, " ")
+}
+
+/*
+ * The status code for an error from addCourse, editCourse or retireCourse,
+ * so that mistakes in the submitted course are not reported as internal
+ * server errors.
+ */
+func courseErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, errCourseInUse):
+		return http.StatusConflict
+	case errors.Is(err, errInvalidCourse),
+		errors.Is(err, errInvalidCourseType),
+		errors.Is(err, errInvalidCourseGroup),
+		errors.Is(err, errNoSuchYearGroup):
+		return http.StatusBadRequest
+	default:
+		return -1
+	}
+}
+
+/*
+ * A course as represented in JSON.
+ */
+type courseJSONT struct {
+	ID       int    `json:"id"`
+	Selected uint32 `json:"selected"`
+	courseInputT
+}
+
+func (course *courseT) toJSON() courseJSONT {
+	info := course.Info()
+	return courseJSONT{
+		ID:       course.ID,
+		Selected: atomic.LoadUint32(&course.Selected),
+		courseInputT: courseInputT{
+			Title:        info.Title,
+			Max:          atomic.LoadUint32(&course.Max),
+			Teacher:      info.Teacher,
+			TeacherEmail: info.TeacherEmail,
+			Location:     info.Location,
+			Type:         info.Type,
+			Group:        info.Group,
+			CourseID:     info.CourseID,
+			SectionID:    info.SectionID,
+			Eligible:     info.Eligible,
+		},
+	}
+}
+
+func (input *courseInputT) info() *courseInfoT {
+	return &courseInfoT{
+		Title:        input.Title,
+		Type:         input.Type,
+		Group:        input.Group,
+		Teacher:      input.Teacher,
+		TeacherEmail: input.TeacherEmail,
+		Location:     input.Location,
+		CourseID:     input.CourseID,
+		SectionID:    input.SectionID,
+		Eligible:     input.Eligible,
+	}
+}
+
+/*
+ * Add a new course and tell connected students that the course list has
+ * changed.
+ */
+func addCourse(ctx context.Context, input courseInputT, actor string) (course *courseT, retErr error) {
+	err := input.check()
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return nil, wrapError(errUnexpectedDBError, err)
+	}
+	defer func() {
+		err := tx.Rollback(ctx)
+		if err != nil && (!errors.Is(err, pgx.ErrTxClosed)) {
+			retErr = wrapError(errUnexpectedDBError, err)
+			return
+		}
+	}()
+
+	course = &courseT{
+		Max: input.Max,
+	} //exhaustruct:ignore
+	course.info.Store(input.info())
+	err = tx.QueryRow(
+		ctx,
+		"INSERT INTO courses(nmax, title, teacher, location, ctype, cgroup, section_id, course_id, eligible, teacher_email) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) RETURNING id",
+		input.Max,
+		input.Title,
+		input.Teacher,
+		input.Location,
+		input.Type,
+		input.Group,
+		input.SectionID,
+		input.CourseID,
+		input.Eligible,
+		input.TeacherEmail,
+	).Scan(&course.ID)
+	if err != nil {
+		return nil, wrapError(errUnexpectedDBError, err)
+	}
+	err = recordAudit(ctx, tx, auditT{
+		Actor:    actor,
+		Action:   auditCourseAdd,
+		CourseID: course.ID,
+		Outcome:  auditAccepted,
+		Note:     input.Title,
+	}) //exhaustruct:ignore
+	if err != nil {
+		return nil, err
+	}
+	err = tx.Commit(ctx)
+	if err != nil {
+		return nil, wrapError(errUnexpectedDBError, err)
+	}
+
+	courses.Store(course.ID, course)
+	atomic.AddUint32(&numCourses, 1)
+	propagate("CL")
+	return course, nil
+}
+
+/*
+ * Check whether anyone has chosen the course, is waiting for it or has ranked
+ * it. The caller should hold course.EditLock. As course.SelectedLock is not
+ * held here, students may still take a seat in the meantime; those are
+ * counted in course.Selected, which the caller should check again with
+ * course.SelectedLock held before relying on the result.
+ */
+func (course *courseT) inUse(ctx context.Context) (bool, error) {
+	if atomic.LoadUint32(&course.Selected) != 0 {
+		return true, nil
+	}
+	var inUse bool
+	err := db.QueryRow(
+		ctx,
+		"SELECT EXISTS (SELECT 1 FROM choices WHERE courseid = $1) OR EXISTS (SELECT 1 FROM waitlist WHERE courseid = $1) OR EXISTS (SELECT 1 FROM preferences WHERE courseid = $1)",
+		course.ID,
+	).Scan(&inUse)
+	if err != nil {
+		return false, wrapError(errUnexpectedDBError, err)
+	}
+	return inUse, nil
+}
+
+/*
+ * Replace the maximum and details of a course, returning the old maximum.
+ * If mustBeUnused is set, nothing is replaced if anyone has taken a seat.
+ */
+func (course *courseT) swap(maxSeats uint32, info *courseInfoT, mustBeUnused bool) (uint32, error) {
+	course.SelectedLock.Lock()
+	defer course.SelectedLock.Unlock()
+	if mustBeUnused && course.Selected != 0 {
+		return 0, errCourseInUse
+	}
+	oldMax := course.Max
+	atomic.StoreUint32(&course.Max, maxSeats)
+	course.info.Store(info)
+	return oldMax, nil
+}
+
+/*
+ * Edit a course in place, while students may be choosing it. The type and
+ * group of a course may only be changed while nobody has chosen, is waiting
+ * for or has ranked it, as they affect the checks performed on existing
+ * choices. Students who passed the checks with the old details are refused a
+ * seat by acquireSeat. If the maximum is raised, the new seats are given to
+ * students on the waitlist first.
+ */
+func editCourse(ctx context.Context, course *courseT, input courseInputT, actor string) error {
+	err := input.check()
+	if err != nil {
+		return err
+	}
+
+	course.EditLock.Lock()
+	defer course.EditLock.Unlock()
+
+	/*
+	 * Edits are sequentialized by the lock, so these are the details that
+	 * are replaced below.
+	 */
+	old := course.Info()
+
+	moved := input.Type != old.Type || input.Group != old.Group
+	if moved {
+		inUse, err := course.inUse(ctx)
+		if err != nil {
+			return err
+		}
+		if inUse {
+			return errCourseInUse
+		}
+	}
+	/*
+	 * Students need to reload the page to see changes that move the
+	 * course around or change whether it could be chosen.
+	 */
+	listChanged := moved || !slices.Equal(input.Eligible, old.Eligible)
+
+	var oldMax uint32
+	err = func() (retErr error) {
+		tx, err := db.Begin(ctx)
+		if err != nil {
+			return wrapError(errUnexpectedDBError, err)
+		}
+		defer func() {
+			err := tx.Rollback(ctx)
+			if err != nil && (!errors.Is(err, pgx.ErrTxClosed)) {
+				retErr = wrapError(errUnexpectedDBError, err)
+				return
+			}
+		}()
+		_, err = tx.Exec(
+			ctx,
+			"UPDATE courses SET nmax = $1, title = $2, teacher = $3, location = $4, ctype = $5, cgroup = $6, section_id = $7, course_id = $8, eligible = $9, teacher_email = $10 WHERE id = $11",
+			input.Max,
+			input.Title,
+			input.Teacher,
+			input.Location,
+			input.Type,
+			input.Group,
+			input.SectionID,
+			input.CourseID,
+			input.Eligible,
+			input.TeacherEmail,
+			course.ID,
+		)
+		if err != nil {
+			return wrapError(errUnexpectedDBError, err)
+		}
+		err = recordAudit(ctx, tx, auditT{
+			Actor:    actor,
+			Action:   auditCourseEdit,
+			CourseID: course.ID,
+			Outcome:  auditAccepted,
+			Note:     input.Title,
+		}) //exhaustruct:ignore
+		if err != nil {
+			return err
+		}
+
+		/*
+		 * Students may have taken a seat since inUse was checked, so
+		 * it is checked again as the details are replaced. This is
+		 * done before committing, so that the edit could still be
+		 * rolled back if it is refused.
+		 */
+		oldMax, err = course.swap(input.Max, input.info(), moved)
+		if err != nil {
+			return err
+		}
+		err = tx.Commit(ctx)
+		if err != nil {
+			_, _ = course.swap(oldMax, old, false)
+			return wrapError(errUnexpectedDBError, err)
+		}
+		return nil
+	}()
+	if err != nil {
+		return err
+	}
+
+	if listChanged {
+		propagate("CL")
+	} else {
+		b, err := json.Marshal(course.toJSON())
+		if err != nil {
+			return wrapError(errCannotMarshalJSON, err)
+		}
+		propagate("C " + strconv.Itoa(course.ID) + " :" + string(b))
+	}
+
+	if input.Max > oldMax {
+		/*
+		 * Seats are only freed as they are taken by students on
+		 * the waitlist; whatever remains is left for everyone.
+		 */
+		for course.acquireSeat(course.Info()) == "" {
+			promoted, err := course.promoteFromWaitlist(ctx)
+			if !promoted {
+				func() {
+					course.SelectedLock.Lock()
+					defer course.SelectedLock.Unlock()
+					atomic.AddUint32(&course.Selected, ^uint32(0))
+				}()
+			}
+			if err != nil {
+				return err
+			}
+			if !promoted {
+				break
+			}
+		}
+	}
+
+	go func() {
+		defer func() {
+			if e := recover(); e != nil {
+				slog.Error("panic", "arg", e)
+			}
+		}()
+		propagateSelectedUpdate(course)
+	}()
+	return nil
+}
+
+/*
+ * Retire a course that nobody has chosen, so that it is no longer shown or
+ * available to students. Anyone waiting for it or ranking it is removed from
+ * its waitlist or their preferences. The course is kept in the database.
+ */
+func retireCourse(ctx context.Context, course *courseT, actor string) error {
+	course.EditLock.Lock()
+	defer course.EditLock.Unlock()
+
+	if atomic.LoadUint32(&course.Selected) != 0 {
+		return errCourseInUse
+	}
+
+	err := func() (retErr error) {
+		tx, err := db.Begin(ctx)
+		if err != nil {
+			return wrapError(errUnexpectedDBError, err)
+		}
+		defer func() {
+			err := tx.Rollback(ctx)
+			if err != nil && (!errors.Is(err, pgx.ErrTxClosed)) {
+				retErr = wrapError(errUnexpectedDBError, err)
+				return
+			}
+		}()
+		_, err = tx.Exec(ctx, "UPDATE courses SET retired = true WHERE id = $1", course.ID)
+		if err != nil {
+			return wrapError(errUnexpectedDBError, err)
+		}
+		_, err = tx.Exec(ctx, "DELETE FROM waitlist WHERE courseid = $1", course.ID)
+		if err != nil {
+			return wrapError(errUnexpectedDBError, err)
+		}
+		_, err = tx.Exec(ctx, "DELETE FROM preferences WHERE courseid = $1", course.ID)
+		if err != nil {
+			return wrapError(errUnexpectedDBError, err)
+		}
+		info := course.Info()
+		err = recordAudit(ctx, tx, auditT{
+			Actor:    actor,
+			Action:   auditCourseRetire,
+			CourseID: course.ID,
+			Outcome:  auditAccepted,
+			Note:     info.Title,
+		}) //exhaustruct:ignore
+		if err != nil {
+			return err
+		}
+
+		/*
+		 * Students who are about to take a seat, having passed the
+		 * other checks already, would find the course full. As in
+		 * editCourse, this is done before committing, in case somebody
+		 * took a seat after the check above.
+		 */
+		oldMax, err := course.swap(0, info, true)
+		if err != nil {
+			return err
+		}
+		err = tx.Commit(ctx)
+		if err != nil {
+			_, _ = course.swap(oldMax, info, false)
+			return wrapError(errUnexpectedDBError, err)
+		}
+		return nil
+	}()
+	if err != nil {
+		return err
+	}
+
+	courses.Delete(course.ID)
+	atomic.AddUint32(&numCourses, ^uint32(0))
+	propagate(fmt.Sprintf("CR %d", course.ID))
+	return nil
+}
@@ -0,0 +1,599 @@
+/*
+ * Parse, preview and apply course list imports
+ *
+ * Copyright (C) 2024  Runxi Yu <https://runxiyu.org>
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+type importRowT struct {
+	Line      int
+	GroupName string
+	courseInputT
+}
+
+/*
+ * A parsed course list. Problems lists everything wrong with it, and the
+ * import may only be applied if there are none.
+ */
+type courseImportT struct {
+	Filename         string
+	Rows             []importRowT
+	HasGroupNames    bool
+	HasTeacherEmails bool /* otherwise teacher emails are kept when updating */
+	Problems         []string
+	Created          time.Time
+}
+
+func (imp *courseImportT) problem(format string, a ...any) {
+	imp.Problems = append(imp.Problems, fmt.Sprintf(format, a...))
+}
+
+/*
+ * Parse a course list given as rows of cells, where the first row contains
+ * the column names. Every problem is collected instead of stopping at the
+ * first one.
+ */
+func parseCourseRecords(filename string, records [][]string) *courseImportT {
+	imp := &courseImportT{
+		Filename: filename,
+		Rows:     make([]importRowT, 0, len(records)),
+		Problems: make([]string, 0),
+		Created:  time.Now(),
+	} //exhaustruct:ignore
+
+	if len(records) == 0 {
+		imp.problem("the file is empty")
+		return imp
+	}
+	titleLine := records[0]
+
+	var titleIndex, maxIndex, teacherIndex, locationIndex,
+		typeIndex, groupIndex, sectionIDIndex,
+		courseIDIndex, groupNameIndex, eligibleIndex,
+		teacherEmailIndex int = -1, -1, -1, -1, -1, -1, -1, -1, -1, -1, -1
+	for i, v := range titleLine {
+		switch strings.TrimSpace(v) {
+		case "Title":
+			titleIndex = i
+		case "Max":
+			maxIndex = i
+		case "Teacher":
+			teacherIndex = i
+		case "Location":
+			locationIndex = i
+		case "Type":
+			typeIndex = i
+		case "Group":
+			groupIndex = i
+		case "Section ID":
+			sectionIDIndex = i
+		case "Course ID":
+			courseIDIndex = i
+		case "Group Name":
+			groupNameIndex = i
+		case "Eligible":
+			eligibleIndex = i
+		case "Teacher Email":
+			teacherEmailIndex = i
+		}
+	}
+
+	missing := false
+	for _, column := range []struct {
+		name  string
+		index int
+	}{
+		{"Title", titleIndex},
+		{"Max", maxIndex},
+		{"Teacher", teacherIndex},
+		{"Location", locationIndex},
+		{"Type", typeIndex},
+		{"Group", groupIndex},
+		{"Course ID", courseIDIndex},
+		{"Section ID", sectionIDIndex},
+	} {
+		if column.index == -1 {
+			imp.problem("missing column \"%s\"", column.name)
+			missing = true
+		}
+	}
+	if missing {
+		return imp
+	}
+
+	/*
+	 * The optional "Group Name" column creates course groups that don't
+	 * exist yet and renames existing ones, unless course groups are
+	 * managed in the configuration file.
+	 */
+	if groupNameIndex != -1 {
+		if config.Groups != nil {
+			imp.problem("course groups are set in the configuration file and cannot be changed with the \"Group Name\" column")
+		} else {
+			imp.HasGroupNames = true
+		}
+	}
+
+	imp.HasTeacherEmails = teacherEmailIndex != -1
+
+	type keyT struct{ courseID, sectionID string }
+	seen := make(map[keyT]int)
+
+	for i, line := range records[1:] {
+		lineNumber := i + 2
+		if slices.IndexFunc(line, func(v string) bool {
+			return strings.TrimSpace(v) != ""
+		}) == -1 {
+			/* Spreadsheets often have blank lines at the end */
+			continue
+		}
+		if len(line) != len(titleLine) {
+			imp.problem(
+				"line %d has %d fields instead of %d",
+				lineNumber,
+				len(line),
+				len(titleLine),
+			)
+			continue
+		}
+		row := importRowT{
+			Line: lineNumber,
+			courseInputT: courseInputT{
+				Title:     line[titleIndex],
+				Teacher:   line[teacherIndex],
+				Location:  line[locationIndex],
+				Type:      line[typeIndex],
+				Group:     line[groupIndex],
+				CourseID:  line[courseIDIndex],
+				SectionID: line[sectionIDIndex],
+				Eligible:  []string{},
+			}, //exhaustruct:ignore
+		} //exhaustruct:ignore
+		if imp.HasGroupNames {
+			row.GroupName = line[groupNameIndex]
+		}
+		if teacherEmailIndex != -1 {
+			row.TeacherEmail = strings.TrimSpace(line[teacherEmailIndex])
+		}
+
+		if row.Title == "" {
+			imp.problem("line %d has no title", lineNumber)
+		}
+		nmax, err := strconv.ParseUint(strings.TrimSpace(line[maxIndex]), 10, 32)
+		if err != nil {
+			imp.problem("line %d has invalid max \"%s\"", lineNumber, line[maxIndex])
+		}
+		row.Max = uint32(nmax)
+		if !checkCourseType(row.Type) {
+			imp.problem(
+				"line %d has invalid course type \"%s\" (allowed course types: %s)",
+				lineNumber,
+				row.Type,
+				strings.Join(getCourseTypeHandles(), ", "),
+			)
+		}
+		if !imp.HasGroupNames && !checkCourseGroup(row.Group) {
+			imp.problem(
+				"line %d has invalid course group \"%s\" (allowed course groups: %s)",
+				lineNumber,
+				row.Group,
+				strings.Join(getCourseGroupHandles(), ", "),
+			)
+		}
+		if eligibleIndex != -1 {
+			row.Eligible, err = parseEligible(line[eligibleIndex])
+			if err != nil {
+				imp.problem("line %d has invalid eligible year groups: %v", lineNumber, err)
+			}
+		}
+		key := keyT{row.CourseID, row.SectionID}
+		if other, ok := seen[key]; ok {
+			imp.problem(
+				"line %d has the same course ID \"%s\" and section ID \"%s\" as line %d",
+				lineNumber,
+				row.CourseID,
+				row.SectionID,
+				other,
+			)
+		} else {
+			seen[key] = lineNumber
+		}
+
+		imp.Rows = append(imp.Rows, row)
+	}
+
+	return imp
+}
+
+/*
+ * Parse an uploaded course list, which may be a CSV, XLSX or ODS file.
+ */
+func parseCourseFile(filename string, data []byte) *courseImportT {
+	records, err := readSpreadsheet(data)
+	if err != nil {
+		imp := parseCourseRecords(filename, nil)
+		imp.Problems = []string{err.Error()}
+		return imp
+	}
+	return parseCourseRecords(filename, records)
+}
+
+type importChangeT struct {
+	Course  courseJSONT
+	Row     importRowT
+	Changes []string
+	Reset   bool /* whether the type or group changes, so choices are deleted */
+}
+
+/*
+ * What applying an import would do to the current courses. Courses are
+ * matched by their course ID and section ID.
+ */
+type importDiffT struct {
+	Added          []importRowT
+	Changed        []importChangeT
+	Removed        []courseJSONT
+	Unchanged      int
+	Choices        int /* all choices, which replacing courses deletes */
+	ResetChoices   int /* choices of courses whose type or group changes */
+	RemovedChoices int /* choices of courses missing from the import */
+}
+
+func diffCourseImport(imp *courseImportT) importDiffT {
+	type keyT struct{ courseID, sectionID string }
+	current := make(map[keyT]courseJSONT)
+	courses.Range(func(_, value interface{}) bool {
+		course, ok := value.(*courseT)
+		if !ok {
+			panic("courses map has non-\"*courseT\" items")
+		}
+		courseJSON := course.toJSON()
+		current[keyT{courseJSON.CourseID, courseJSON.SectionID}] = courseJSON
+		return true
+	})
+
+	diff := importDiffT{
+		Added:   make([]importRowT, 0),
+		Changed: make([]importChangeT, 0),
+		Removed: make([]courseJSONT, 0),
+	} //exhaustruct:ignore
+	for _, row := range imp.Rows {
+		key := keyT{row.CourseID, row.SectionID}
+		course, ok := current[key]
+		if !ok {
+			diff.Added = append(diff.Added, row)
+			continue
+		}
+		delete(current, key)
+		changes := make([]string, 0)
+		for _, field := range []struct {
+			name     string
+			old, new string
+		}{
+			{"title", course.Title, row.Title},
+			{"max", strconv.FormatUint(uint64(course.Max), 10), strconv.FormatUint(uint64(row.Max), 10)},
+			{"teacher", course.Teacher, row.Teacher},
+			{"teacher email", course.TeacherEmail, row.TeacherEmail},
+			{"location", course.Location, row.Location},
+			{"type", course.Type, row.Type},
+			{"group", course.Group, row.Group},
+			{"eligible", course.EligibleString(), row.EligibleString()},
+		} {
+			if field.name == "teacher email" && !imp.HasTeacherEmails {
+				continue
+			}
+			if field.old != field.new {
+				changes = append(changes, fmt.Sprintf("%s: \"%s\" → \"%s\"", field.name, field.old, field.new))
+			}
+		}
+		if len(changes) == 0 {
+			diff.Unchanged++
+			continue
+		}
+		reset := course.Type != row.Type || course.Group != row.Group
+		if reset {
+			diff.ResetChoices += int(course.Selected)
+		}
+		diff.Changed = append(diff.Changed, importChangeT{course, row, changes, reset})
+	}
+	for _, course := range current {
+		diff.Removed = append(diff.Removed, course)
+		diff.RemovedChoices += int(course.Selected)
+	}
+	slices.SortFunc(diff.Removed, func(a, b courseJSONT) int {
+		return a.ID - b.ID
+	})
+
+	courses.Range(func(_, value interface{}) bool {
+		course, ok := value.(*courseT)
+		if !ok {
+			panic("courses map has non-\"*courseT\" items")
+		}
+		diff.Choices += int(atomic.LoadUint32(&course.Selected))
+		return true
+	})
+	return diff
+}
+
+/*
+ * Imports that have been previewed are kept here until they are applied, so
+ * that the file does not have to be uploaded again. They expire after an
+ * hour.
+ */
+var pendingImports sync.Map /* string, *courseImportT */
+
+const pendingImportLifetime = time.Hour
+
+func storePendingImport(imp *courseImportT) (string, error) {
+	pendingImports.Range(func(key, value interface{}) bool {
+		other, ok := value.(*courseImportT)
+		if !ok {
+			panic("pendingImports has non-\"*courseImportT\" items")
+		}
+		if time.Since(other.Created) > pendingImportLifetime {
+			pendingImports.Delete(key)
+		}
+		return true
+	})
+	token, err := randomString(8)
+	if err != nil {
+		return "", err
+	}
+	pendingImports.Store(token, imp)
+	return token, nil
+}
+
+func takePendingImport(token string) (*courseImportT, bool) {
+	_imp, ok := pendingImports.LoadAndDelete(token)
+	if !ok {
+		return nil, false
+	}
+	imp, ok := _imp.(*courseImportT)
+	if !ok {
+		panic("pendingImports has non-\"*courseImportT\" items")
+	}
+	if time.Since(imp.Created) > pendingImportLifetime {
+		return nil, false
+	}
+	return imp, true
+}
+
+/*
+ * Delete everything that refers to the course, unconfirming students who
+ * chose it, as it is about to be retired or to have its type or group
+ * changed.
+ */
+func resetCourse(ctx context.Context, tx pgx.Tx, courseID int) error {
+	for _, query := range []string{
+		"UPDATE users SET confirmed = false WHERE id IN (SELECT userid FROM choices WHERE courseid = $1)",
+		"DELETE FROM choices WHERE courseid = $1",
+		"DELETE FROM waitlist WHERE courseid = $1",
+		"DELETE FROM preferences WHERE courseid = $1",
+	} {
+		_, err := tx.Exec(ctx, query, courseID)
+		if err != nil {
+			return wrapError(errUnexpectedDBError, err)
+		}
+	}
+	return nil
+}
+
+/*
+ * Apply an import. If replace is true, all courses are replaced with the
+ * imported ones, and all choices, waitlists and preferences are deleted.
+ * Otherwise, courses are matched by their course ID and section ID (including
+ * retired ones, which are brought back), and updated in place, keeping their
+ * choices unless their type or group changes; courses that are missing from
+ * the import are retired if retireMissing is true. The caller is responsible
+ * for reloading course groups and courses afterwards.
+ */
+func applyCourseImport(
+	ctx context.Context,
+	imp *courseImportT,
+	replace bool,
+	retireMissing bool,
+	actor string,
+) (retErr error) {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return wrapError(errUnexpectedDBError, err)
+	}
+	defer func() {
+		err := tx.Rollback(ctx)
+		if err != nil && (!errors.Is(err, pgx.ErrTxClosed)) {
+			retErr = wrapError(errUnexpectedDBError, err)
+			return
+		}
+	}()
+
+	if replace {
+		for _, query := range []string{
+			"DELETE FROM choices",
+			"DELETE FROM waitlist",
+			"DELETE FROM preferences",
+			"UPDATE users SET confirmed = false",
+			"DELETE FROM courses",
+		} {
+			_, err = tx.Exec(ctx, query)
+			if err != nil {
+				return wrapError(errUnexpectedDBError, err)
+			}
+		}
+	}
+
+	type keyT struct{ courseID, sectionID string }
+	type existingT struct {
+		id           int
+		ctype        string
+		cgroup       string
+		retired      bool
+		seenInImport bool
+	}
+	existing := make(map[keyT]*existingT)
+	rows, err := tx.Query(
+		ctx,
+		"SELECT id, course_id, section_id, ctype, cgroup, retired FROM courses ORDER BY retired, id",
+	)
+	if err != nil {
+		return wrapError(errUnexpectedDBError, err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var key keyT
+		course := &existingT{} //exhaustruct:ignore
+		err := rows.Scan(&course.id, &key.courseID, &key.sectionID, &course.ctype, &course.cgroup, &course.retired)
+		if err != nil {
+			return wrapError(errUnexpectedDBError, err)
+		}
+		/* Prefer courses that are not retired, then older ones */
+		if _, ok := existing[key]; !ok {
+			existing[key] = course
+		}
+	}
+	err = rows.Err()
+	if err != nil {
+		return wrapError(errUnexpectedDBError, err)
+	}
+
+	var added, updated, retired int
+	seenGroups := make(map[string]struct{})
+	for _, row := range imp.Rows {
+		if imp.HasGroupNames {
+			if _, ok := seenGroups[row.Group]; !ok {
+				_, err = tx.Exec(
+					ctx,
+					"INSERT INTO groups (handle, name, ord) VALUES ($1, $2, (SELECT COALESCE(MAX(ord), -1) + 1 FROM groups)) ON CONFLICT (handle) DO UPDATE SET name = EXCLUDED.name",
+					row.Group,
+					row.GroupName,
+				)
+				if err != nil {
+					return wrapError(errUnexpectedDBError, err)
+				}
+				seenGroups[row.Group] = struct{}{}
+			}
+		}
+
+		course, ok := existing[keyT{row.CourseID, row.SectionID}]
+		if !ok {
+			_, err = tx.Exec(
+				ctx,
+				"INSERT INTO courses(nmax, title, teacher, location, ctype, cgroup, section_id, course_id, eligible, teacher_email) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)",
+				row.Max,
+				row.Title,
+				row.Teacher,
+				row.Location,
+				row.Type,
+				row.Group,
+				row.SectionID,
+				row.CourseID,
+				row.Eligible,
+				row.TeacherEmail,
+			)
+			if err != nil {
+				return wrapError(errUnexpectedDBError, err)
+			}
+			added++
+			continue
+		}
+
+		course.seenInImport = true
+		if course.ctype != row.Type || course.cgroup != row.Group {
+			err = resetCourse(ctx, tx, course.id)
+			if err != nil {
+				return err
+			}
+		}
+		var teacherEmail *string
+		if imp.HasTeacherEmails {
+			teacherEmail = &row.TeacherEmail
+		}
+		_, err = tx.Exec(
+			ctx,
+			"UPDATE courses SET nmax = $1, title = $2, teacher = $3, location = $4, ctype = $5, cgroup = $6, eligible = $7, retired = false, teacher_email = COALESCE($9, teacher_email) WHERE id = $8",
+			row.Max,
+			row.Title,
+			row.Teacher,
+			row.Location,
+			row.Type,
+			row.Group,
+			row.Eligible,
+			course.id,
+			teacherEmail,
+		)
+		if err != nil {
+			return wrapError(errUnexpectedDBError, err)
+		}
+		updated++
+	}
+
+	if retireMissing {
+		for _, course := range existing {
+			if course.seenInImport || course.retired {
+				continue
+			}
+			err = resetCourse(ctx, tx, course.id)
+			if err != nil {
+				return err
+			}
+			_, err = tx.Exec(ctx, "UPDATE courses SET retired = true WHERE id = $1", course.id)
+			if err != nil {
+				return wrapError(errUnexpectedDBError, err)
+			}
+			retired++
+		}
+	}
+
+	note := fmt.Sprintf(
+		"%s: %d added, %d updated, %d retired",
+		imp.Filename,
+		added,
+		updated,
+		retired,
+	)
+	if replace {
+		note = fmt.Sprintf("%s: replaced with %d courses", imp.Filename, added)
+	}
+	err = recordAudit(ctx, tx, auditT{
+		Actor:   actor,
+		Action:  auditImport,
+		Outcome: auditAccepted,
+		Note:    note,
+	}) //exhaustruct:ignore
+	if err != nil {
+		return err
+	}
+	err = tx.Commit(ctx)
+	if err != nil {
+		return wrapError(errUnexpectedDBError, err)
+	}
+	return nil
+}
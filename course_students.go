@@ -0,0 +1,107 @@
+/*
+ * Students enrolled in each course
+ *
+ * Copyright (C) 2024  Runxi Yu <https://runxiyu.org>
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+/*
+ * Whether the course is taught by the given teacher, matched by the course's
+ * teacher email if it has one, or otherwise by the teacher's name.
+ */
+func (course *courseT) taughtBy(name string, email string) bool {
+	info := course.Info()
+	if info.TeacherEmail != "" {
+		return strings.EqualFold(info.TeacherEmail, email)
+	}
+	return name != "" && strings.EqualFold(strings.TrimSpace(info.Teacher), strings.TrimSpace(name))
+}
+
+/*
+ * Courses taught by the given teacher, sorted by ID.
+ */
+func getCoursesTaughtBy(name string, email string) []*courseT {
+	taught := make([]*courseT, 0)
+	courses.Range(func(_, value interface{}) bool {
+		course, ok := value.(*courseT)
+		if !ok {
+			panic("courses map has non-\"*courseT\" items")
+		}
+		if course.taughtBy(name, email) {
+			taught = append(taught, course)
+		}
+		return true
+	})
+	slices.SortFunc(taught, func(a, b *courseT) int {
+		return a.ID - b.ID
+	})
+	return taught
+}
+
+func getUserEmail(ctx context.Context, userID string) (string, error) {
+	var email string
+	err := db.QueryRow(ctx, "SELECT email FROM users WHERE id = $1", userID).Scan(&email)
+	if err != nil {
+		return "", wrapError(errUnexpectedDBError, err)
+	}
+	return email, nil
+}
+
+type courseStudentT struct {
+	UserID     string
+	Name       string
+	Email      string
+	StudentID  string
+	Department string
+	Time       time.Time
+}
+
+/*
+ * Students who have chosen the course, in the order in which they chose it.
+ */
+func getCourseStudents(ctx context.Context, courseID int) ([]courseStudentT, error) {
+	rows, err := db.Query(
+		ctx,
+		"SELECT u.id, u.name, u.email, COALESCE(u.student_id, ''), u.department, c.seltime FROM choices c JOIN users u ON u.id = c.userid WHERE c.courseid = $1 ORDER BY c.seltime",
+		courseID,
+	)
+	if err != nil {
+		return nil, wrapError(errUnexpectedDBError, err)
+	}
+	students, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (courseStudentT, error) {
+		var student courseStudentT
+		var selTime int64
+		err := row.Scan(&student.UserID, &student.Name, &student.Email, &student.StudentID, &student.Department, &selTime)
+		student.StudentID = studentIDOf(student.StudentID, student.Email)
+		student.Time = time.UnixMicro(selTime)
+		return student, err
+	})
+	if err != nil {
+		return nil, wrapError(errUnexpectedDBError, err)
+	}
+	return students, nil
+}
@@ -22,107 +22,256 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/jackc/pgx/v5"
 )
 
 /* Course types, e.g. Sport */
 
-const (
-	sport    string = "Sport"
-	nonSport string = "Non-sport"
-)
+/*
+ * Course types are defined in the configuration file. Handle is what is used
+ * in the course list and in requirements, while Name and Colour are only used
+ * for display.
+ */
+type courseTypeT struct {
+	Handle string
+	Name   string
+	Colour string
+}
 
-var courseTypes = map[string]struct{}{
-	sport:    {},
-	nonSport: {},
+func getCourseType(ct string) (courseTypeT, bool) {
+	for _, t := range config.Types {
+		if t.Handle == ct {
+			return t, true
+		}
+	}
+	return courseTypeT{Handle: "", Name: "", Colour: ""}, false
 }
 
 func checkCourseType(ct string) bool {
-	_, ok := courseTypes[ct]
+	_, ok := getCourseType(ct)
 	return ok
 }
 
+func getCourseTypeHandles() []string {
+	o := make([]string, 0, len(config.Types))
+	for _, t := range config.Types {
+		o = append(o, t.Handle)
+	}
+	return o
+}
+
 type userCourseTypesT map[string]int
 
-func getCourseTypeMinimumForYearGroup(yearGroup, courseType string) (int, error) {
-	switch yearGroup {
-	case "Y9":
-		switch courseType {
-		case sport:
-			return config.Req.Y9.Sport, nil
-		case nonSport:
-			return config.Req.Y9.NonSport, nil
-		default:
-			return 0, errInvalidCourseType
-		}
-	case "Y10":
-		switch courseType {
-		case sport:
-			return config.Req.Y10.Sport, nil
-		case nonSport:
-			return config.Req.Y10.NonSport, nil
-		default:
-			return 0, errInvalidCourseType
-		}
-	case "Y11":
-		switch courseType {
-		case sport:
-			return config.Req.Y11.Sport, nil
-		case nonSport:
-			return config.Req.Y11.NonSport, nil
-		default:
-			return 0, errInvalidCourseType
-		}
-	case "Y12":
-		switch courseType {
-		case sport:
-			return config.Req.Y12.Sport, nil
-		case nonSport:
-			return config.Req.Y12.NonSport, nil
-		default:
-			return 0, errInvalidCourseType
-		}
-	default:
-		return 0, errNoSuchYearGroup
+/*
+ * Requirements for each course type in a year group. Max is negative if
+ * there is no upper limit.
+ */
+type courseTypeRequirementT struct {
+	Min int
+	Max int
+}
+
+/*
+ * Max is the maximum number of courses of any type, and is negative if there
+ * is no upper limit.
+ */
+type yearGroupRequirementsT struct {
+	Max   int
+	Types map[string]courseTypeRequirementT
+}
+
+func getMaxChoicesForYearGroup(yearGroup string) (int, error) {
+	requirements, ok := config.Req[yearGroup]
+	if !ok {
+		return -1, errNoSuchYearGroup
 	}
+	return requirements.Max, nil
+}
+
+func (userCourseTypes *userCourseTypesT) total() int {
+	n := 0
+	for _, v := range *userCourseTypes {
+		n += v
+	}
+	return n
+}
+
+/*
+ * Course types that are not mentioned in a year group's configuration have
+ * no minimum and no maximum.
+ */
+func getCourseTypeRequirementForYearGroup(yearGroup, courseType string) (courseTypeRequirementT, error) {
+	requirements, ok := config.Req[yearGroup]
+	if !ok {
+		return courseTypeRequirementT{Min: 0, Max: -1}, errNoSuchYearGroup
+	}
+	if !checkCourseType(courseType) {
+		return courseTypeRequirementT{Min: 0, Max: -1}, errInvalidCourseType
+	}
+	requirement, ok := requirements.Types[courseType]
+	if !ok {
+		return courseTypeRequirementT{Min: 0, Max: -1}, nil
+	}
+	return requirement, nil
 }
 
 /* Course groups, e.g. MW1 */
 
 type userCourseGroupsT map[string]struct{}
 
-func checkCourseGroup(cg string) bool {
-	_, ok := courseGroups[cg]
-	return ok
+type courseGroupT struct {
+	Handle string
+	Name   string
 }
 
-const (
-	mw1 string = "MW1"
-	mw2 string = "MW2"
-	mw3 string = "MW3"
-	tt1 string = "TT1"
-	tt2 string = "TT2"
-	tt3 string = "TT3"
+/*
+ * Course groups are stored in the groups table, in the order that they should
+ * be displayed in. They are only written during setup and course imports, but
+ * are read from every request handler, hence the lock.
+ */
+var (
+	courseGroups     []courseGroupT
+	courseGroupsLock sync.RWMutex
 )
 
-var courseGroups = map[string]string{
-	mw1: "Monday/Wednesday CCA1",
-	mw2: "Monday/Wednesday CCA2",
-	mw3: "Monday/Wednesday CCA3",
-	tt1: "Tuesday/Thursday CCA1",
-	tt2: "Tuesday/Thursday CCA2",
-	tt3: "Tuesday/Thursday CCA3",
+func checkCourseGroup(cg string) bool {
+	courseGroupsLock.RLock()
+	defer courseGroupsLock.RUnlock()
+	for _, g := range courseGroups {
+		if g.Handle == cg {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ * Returns a copy of the list of course groups, so the caller doesn't need to
+ * hold the lock while using it.
+ */
+func getCourseGroups() []courseGroupT {
+	courseGroupsLock.RLock()
+	defer courseGroupsLock.RUnlock()
+	o := make([]courseGroupT, len(courseGroups))
+	copy(o, courseGroups)
+	return o
+}
+
+func getCourseGroupHandles() []string {
+	courseGroupsLock.RLock()
+	defer courseGroupsLock.RUnlock()
+	o := make([]string, 0, len(courseGroups))
+	for _, g := range courseGroups {
+		o = append(o, g.Handle)
+	}
+	return o
+}
+
+/*
+ * Read course groups from the database. If course groups are configured in
+ * the configuration file, they replace whatever is in the database first.
+ * This should be called during setup and after the groups table changes.
+ */
+func setupCourseGroups(ctx context.Context) error {
+	if config.Groups != nil {
+		err := saveConfiguredCourseGroups(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	rows, err := db.Query(
+		ctx,
+		"SELECT handle, name FROM groups ORDER BY ord",
+	)
+	if err != nil {
+		return wrapError(errUnexpectedDBError, err)
+	}
+	newCourseGroups, err := pgx.CollectRows(rows, pgx.RowToStructByPos[courseGroupT])
+	if err != nil {
+		return wrapError(errUnexpectedDBError, err)
+	}
+
+	courseGroupsLock.Lock()
+	defer courseGroupsLock.Unlock()
+	courseGroups = newCourseGroups
+	return nil
+}
+
+func saveConfiguredCourseGroups(ctx context.Context) (retErr error) {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return wrapError(errUnexpectedDBError, err)
+	}
+	defer func() {
+		err := tx.Rollback(ctx)
+		if err != nil && (!errors.Is(err, pgx.ErrTxClosed)) {
+			retErr = wrapError(errUnexpectedDBError, err)
+			return
+		}
+	}()
+
+	_, err = tx.Exec(ctx, "DELETE FROM groups")
+	if err != nil {
+		return wrapError(errUnexpectedDBError, err)
+	}
+	for i, g := range config.Groups {
+		_, err = tx.Exec(
+			ctx,
+			"INSERT INTO groups (handle, name, ord) VALUES ($1, $2, $3)",
+			g.Handle,
+			g.Name,
+			i,
+		)
+		if err != nil {
+			return wrapError(errUnexpectedDBError, err)
+		}
+	}
+
+	/*
+	 * Courses may not be left in groups that were removed from the
+	 * configuration file, as they could not be shown to anyone.
+	 */
+	rows, err := tx.Query(
+		ctx,
+		"SELECT DISTINCT cgroup FROM courses WHERE NOT retired AND cgroup NOT IN (SELECT handle FROM groups) ORDER BY cgroup",
+	)
+	if err != nil {
+		return wrapError(errUnexpectedDBError, err)
+	}
+	missing, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return wrapError(errUnexpectedDBError, err)
+	}
+	if len(missing) != 0 {
+		return wrapAny(
+			errInvalidConfigValue,
+			"groups does not contain groups that courses are in: "+strings.Join(missing, ", "),
+		)
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return wrapError(errUnexpectedDBError, err)
+	}
+	return nil
 }
 
 /* Populate both */
 
 func populateUserCourseTypesAndGroups(
 	ctx context.Context,
+	q dbQuerier,
 	userCourseTypes *userCourseTypesT,
 	userCourseGroups *userCourseGroupsT,
 	userID string,
 ) error {
-	rows, err := db.Query(
+	rows, err := q.Query(
 		ctx,
 		"SELECT courseid FROM choices WHERE userid = $1",
 		userID,
@@ -165,8 +314,9 @@ func populateUserCourseTypesAndGroups(
 		if !ok {
 			panic("courses map has non-\"*courseT\" items")
 		}
-		thisGroupName = course.Group
-		thisTypeName = course.Type
+		info := course.Info()
+		thisGroupName = info.Group
+		thisTypeName = info.Type
 		if _, ok := (*userCourseGroups)[thisGroupName]; ok {
 			return fmt.Errorf(
 				"%w: user %v, group %v",
@@ -22,12 +22,14 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
+	"strings"
 	"sync"
 	"sync/atomic"
 
-	"github.com/coder/websocket"
+	"github.com/jackc/pgx/v5"
 )
 
 type courseT struct {
@@ -42,15 +44,89 @@ type courseT struct {
 	Selected     uint32 /* atomic */
 	SelectedLock sync.Mutex
 	ID           int
-	Max          uint32
+	Max          uint32 /* atomic; only written with SelectedLock held */
+	info         atomic.Pointer[courseInfoT]
+	Usems        sync.Map /* string, *usemT */
+	/*
+	 * EditLock sequentializes edits to the course by staff. It is held
+	 * across database transactions, unlike SelectedLock, so that students
+	 * choosing the course never wait for them.
+	 */
+	EditLock sync.Mutex
+}
+
+/*
+ * The details of a course that staff may edit. Courses are edited while
+ * students may be choosing them, so these are never modified in place, but
+ * replaced as a whole.
+ */
+type courseInfoT struct {
 	Title        string
 	Type         string
 	Group        string
 	Teacher      string
+	TeacherEmail string /* may be empty */
 	Location     string
 	CourseID     string
 	SectionID    string
-	Usems        sync.Map /* string, *usemT */
+	Eligible     []string /* year groups; empty if open to everyone */
+}
+
+/*
+ * The current details of the course. Callers that read several of them
+ * should call this once, to see them all from the same edit.
+ */
+func (course *courseT) Info() *courseInfoT {
+	return course.info.Load()
+}
+
+func (info *courseInfoT) EligibleFor(yearGroup string) bool {
+	if len(info.Eligible) == 0 {
+		return true
+	}
+	for _, e := range info.Eligible {
+		if e == yearGroup {
+			return true
+		}
+	}
+	return false
+}
+
+func (info *courseInfoT) EligibleString() string {
+	if len(info.Eligible) == 0 {
+		return "All"
+	}
+	return strings.Join(info.Eligible, " ")
+}
+
+/*
+ * Parse a list of eligible year groups separated by spaces or commas, as
+ * written in the course list.
+ */
+func parseEligible(s string) ([]string, error) {
+	eligible := strings.FieldsFunc(s, func(r rune) bool {
+		return r == ' ' || r == ','
+	})
+	for _, e := range eligible {
+		if _, ok := config.Req[e]; !ok {
+			return nil, wrapAny(errNoSuchYearGroup, e)
+		}
+	}
+	return eligible, nil
+}
+
+/*
+ * These are used in templates to display the course type. The course type
+ * is always valid as it is checked when courses are loaded.
+ */
+func (info *courseInfoT) TypeName() string {
+	courseType, _ := getCourseType(info.Type)
+	return courseType.Name
+}
+
+func (info *courseInfoT) TypeColour() string {
+	courseType, _ := getCourseType(info.Type)
+	return courseType.Colour
 }
 
 var courses sync.Map /* int, *courseT */
@@ -59,6 +135,13 @@ var numCourses uint32 /* atomic */
 
 const staffDepartment = "Staff"
 
+/*
+ * Teachers may only see the students in their own courses.
+ */
+const teacherDepartment = "Teacher"
+
+var nonStudentDepartments = []string{staffDepartment, teacherDepartment}
+
 /*
  * Read course information from the database. This should be called during
  * setup.
@@ -66,7 +149,7 @@ const staffDepartment = "Staff"
 func setupCourses(ctx context.Context) error {
 	rows, err := db.Query(
 		ctx,
-		"SELECT id, nmax, title, ctype, cgroup, teacher, location, course_id, section_id FROM courses",
+		"SELECT id, nmax, title, ctype, cgroup, teacher, teacher_email, location, course_id, section_id, eligible FROM courses WHERE NOT retired",
 	)
 	if err != nil {
 		return wrapError(errUnexpectedDBError, err)
@@ -84,36 +167,40 @@ func setupCourses(ctx context.Context) error {
 			break
 		}
 		currentCourse := courseT{} //exhaustruct:ignore
+		info := courseInfoT{}      //exhaustruct:ignore
 		err = rows.Scan(
 			&currentCourse.ID,
 			&currentCourse.Max,
-			&currentCourse.Title,
-			&currentCourse.Type,
-			&currentCourse.Group,
-			&currentCourse.Teacher,
-			&currentCourse.Location,
-			&currentCourse.CourseID,
-			&currentCourse.SectionID,
+			&info.Title,
+			&info.Type,
+			&info.Group,
+			&info.Teacher,
+			&info.TeacherEmail,
+			&info.Location,
+			&info.CourseID,
+			&info.SectionID,
+			&info.Eligible,
 		)
 		if err != nil {
 			return wrapError(errUnexpectedDBError, err)
 		}
-		if !checkCourseType(currentCourse.Type) {
+		if !checkCourseType(info.Type) {
 			return fmt.Errorf(
 				"%w: %d %s",
 				errInvalidCourseType,
 				currentCourse.ID,
-				currentCourse.Type,
+				info.Type,
 			)
 		}
-		if !checkCourseGroup(currentCourse.Group) {
+		if !checkCourseGroup(info.Group) {
 			return fmt.Errorf(
 				"%w: %d %s",
 				errInvalidCourseGroup,
 				currentCourse.ID,
-				currentCourse.Group,
+				info.Group,
 			)
 		}
+		currentCourse.info.Store(&info)
 		err := db.QueryRow(
 			ctx,
 			"SELECT COUNT (*) FROM choices WHERE courseid = $1",
@@ -132,15 +219,82 @@ func setupCourses(ctx context.Context) error {
 	return nil
 }
 
-func (course *courseT) decrementSelectedAndPropagate(
-	ctx context.Context,
-	conn *websocket.Conn,
-) error {
-	func() {
+/*
+ * Reserve a seat in the course for a student who passed the checks with the
+ * given details of the course. The returned reason is empty if a seat was
+ * reserved. If the course has been edited since, the checks might no longer
+ * hold, so no seat is reserved; editCourse relies on this, as it only checks
+ * course.Selected and replaces the details while holding SelectedLock.
+ */
+func (course *courseT) acquireSeat(info *courseInfoT) string {
+	course.SelectedLock.Lock()
+	defer course.SelectedLock.Unlock()
+	if course.Info() != info {
+		return "Course changed"
+	}
+	/*
+	 * The reads here don't have to be atomic because the lock
+	 * guarantees that no other goroutine is writing to them.
+	 */
+	if course.Selected < course.Max {
+		atomic.AddUint32(&course.Selected, 1)
+		return ""
+	}
+	return "Full"
+}
+
+/*
+ * Take a seat in the course regardless of whether it is full. This is only
+ * for staff overrides. As with acquireSeat, no seat is taken if the course
+ * has been edited since info was read.
+ */
+func (course *courseT) forceSeat(info *courseInfoT) string {
+	course.SelectedLock.Lock()
+	defer course.SelectedLock.Unlock()
+	if course.Info() != info {
+		return "Course changed"
+	}
+	atomic.AddUint32(&course.Selected, 1)
+	return ""
+}
+
+/*
+ * Release a seat in the course, after a choice has been removed from the
+ * database. If anyone is waiting for the course, the seat is handed over to
+ * the head of the waitlist instead, without ever becoming available to
+ * others in between.
+ */
+func (course *courseT) releaseSeat(ctx context.Context) error {
+	/*
+	 * The promotion should proceed even if whoever freed the seat
+	 * disconnects in the meantime.
+	 */
+	ctx = context.WithoutCancel(ctx)
+
+	overfull := func() bool {
 		course.SelectedLock.Lock()
 		defer course.SelectedLock.Unlock()
-		atomic.AddUint32(&course.Selected, ^uint32(0))
+		if course.Selected > course.Max {
+			atomic.AddUint32(&course.Selected, ^uint32(0))
+			return true
+		}
+		return false
 	}()
+
+	var err error
+	if !overfull {
+		var promoted bool
+		promoted, err = course.promoteFromWaitlist(ctx)
+		if promoted {
+			return nil
+		}
+		func() {
+			course.SelectedLock.Lock()
+			defer course.SelectedLock.Unlock()
+			atomic.AddUint32(&course.Selected, ^uint32(0))
+		}()
+	}
+
 	go func() {
 		defer func() {
 			if e := recover(); e != nil {
@@ -149,12 +303,100 @@ func (course *courseT) decrementSelectedAndPropagate(
 		}()
 		propagateSelectedUpdate(course)
 	}()
-	err := sendSelectedUpdate(ctx, conn, course.ID)
-	if err != nil {
-		return wrapError(
-			errCannotSend,
-			err,
-		)
+	return err
+}
+
+/*
+ * Give a seat that the caller has reserved to the earliest student on the
+ * waitlist who may still choose the course. Students who may no longer
+ * choose it (e.g. because they have since chosen another course in the same
+ * group) are removed from the waitlist and notified. The returned bool is
+ * true if the seat has been taken by someone.
+ */
+func (course *courseT) promoteFromWaitlist(ctx context.Context) (bool, error) {
+	for {
+		var userID, department string
+		err := db.QueryRow(
+			ctx,
+			"SELECT w.userid, u.department FROM waitlist w JOIN users u ON u.id = w.userid WHERE w.courseid = $1 ORDER BY w.jointime LIMIT 1",
+			course.ID,
+		).Scan(&userID, &department)
+		if err != nil {
+			if errors.Is(err, pgx.ErrNoRows) {
+				return false, nil
+			}
+			return false, wrapError(errUnexpectedDBError, err)
+		}
+
+		reason, inserted, err := func() (reason string, inserted bool, retErr error) {
+			tx, err := db.Begin(ctx)
+			if err != nil {
+				return "", false, wrapError(errUnexpectedDBError, err)
+			}
+			defer func() {
+				err := tx.Rollback(ctx)
+				if err != nil && (!errors.Is(err, pgx.ErrTxClosed)) {
+					retErr = wrapError(errUnexpectedDBError, err)
+					return
+				}
+			}()
+
+			ct, err := tx.Exec(
+				ctx,
+				"DELETE FROM waitlist WHERE userid = $1 AND courseid = $2",
+				userID,
+				course.ID,
+			)
+			if err != nil {
+				return "", false, wrapError(errUnexpectedDBError, err)
+			}
+			if ct.RowsAffected() == 0 {
+				/* Someone else got to them first */
+				return "", false, nil
+			}
+
+			/*
+			 * The seat is already held, so the course's type
+			 * and group could not be changed in the meantime.
+			 */
+			reason, inserted, err = insertChoice(ctx, tx, userID, department, course, course.Info())
+			if err != nil {
+				return "", false, err
+			}
+
+			outcome := reason
+			if inserted {
+				outcome = auditAccepted
+			}
+			if outcome != "" {
+				err = recordAudit(ctx, tx, auditT{
+					UserID:   userID,
+					Actor:    auditActorWaitlist,
+					Action:   auditPromote,
+					CourseID: course.ID,
+					Outcome:  outcome,
+				}) //exhaustruct:ignore
+				if err != nil {
+					return "", false, err
+				}
+			}
+
+			err = tx.Commit(ctx)
+			if err != nil {
+				return "", false, wrapError(errUnexpectedDBError, err)
+			}
+			return reason, inserted, nil
+		}()
+		if err != nil {
+			return false, err
+		}
+
+		if inserted {
+			sendToUser(userID, fmt.Sprintf("Y %d", course.ID))
+			return true, nil
+		}
+		if reason != "" {
+			sendToUser(userID, fmt.Sprintf("RW %d :%s", course.ID, reason))
+		}
 	}
-	return nil
 }
@@ -23,11 +23,23 @@ package main
 import (
 	"context"
 
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
 var db *pgxpool.Pool
 
+/*
+ * dbQuerier is satisfied by both *pgxpool.Pool and pgx.Tx, so that functions
+ * can be used both inside and outside of transactions.
+ */
+type dbQuerier interface {
+	Exec(ctx context.Context, sql string, arguments ...any) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
 const pgErrUniqueViolation = "23505"
 
 /*
@@ -0,0 +1,535 @@
+/*
+ * JSON API
+ *
+ * Copyright (C) 2024  Runxi Yu <https://runxiyu.org>
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+ * The JSON API is versioned by its path, and described by docs/openapi.json.
+ * It follows the same permission rules as the rest of the site. Errors are
+ * reported as plain text, as elsewhere.
+ */
+
+func readJSON(req *http.Request, v any) error {
+	err := json.NewDecoder(req.Body).Decode(v)
+	if err != nil {
+		return wrapError(errCannotUnmarshalJSON, err)
+	}
+	return nil
+}
+
+func handleAPIOpenAPI(w http.ResponseWriter, req *http.Request) (string, int, error) {
+	_ = req
+	b, err := fs.ReadFile(runFS, "build/docs/openapi.json")
+	if err != nil {
+		return "", http.StatusNotFound, wrapError(errNoSuchFile, err)
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_, err = w.Write(b)
+	if err != nil {
+		return "", -1, wrapError(errHTTPWrite, err)
+	}
+	return "", -1, nil
+}
+
+/*
+ * GET lists all courses, while POST adds a course.
+ */
+func handleAPICourses(w http.ResponseWriter, req *http.Request) (string, int, error) {
+	userID, _, department, err := getUserInfoFromRequest(req)
+	if err != nil {
+		return "", -1, err
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		list := make([]courseJSONT, 0)
+		courses.Range(func(_, value interface{}) bool {
+			course, ok := value.(*courseT)
+			if !ok {
+				panic("courses map has non-\"*courseT\" items")
+			}
+			list = append(list, course.toJSON())
+			return true
+		})
+		err := writeJSON(w, http.StatusOK, list)
+		if err != nil {
+			return "", -1, err
+		}
+		return "", -1, nil
+	case http.MethodPost:
+		if department != staffDepartment {
+			return "", http.StatusForbidden, errStaffOnly
+		}
+		var input courseInputT
+		err := readJSON(req, &input)
+		if err != nil {
+			return "", http.StatusBadRequest, err
+		}
+		course, err := addCourse(req.Context(), input, userID)
+		if err != nil {
+			return "", courseErrorStatus(err), err
+		}
+		err = writeJSON(w, http.StatusCreated, course.toJSON())
+		if err != nil {
+			return "", -1, err
+		}
+		return "", -1, nil
+	default:
+		return "", http.StatusMethodNotAllowed, errMethodNotAllowed
+	}
+}
+
+/*
+ * GET shows a course, PUT replaces its fields, and DELETE retires it.
+ */
+func handleAPICourse(w http.ResponseWriter, req *http.Request) (string, int, error) {
+	userID, _, department, err := getUserInfoFromRequest(req)
+	if err != nil {
+		return "", -1, err
+	}
+
+	course, err := loadCourseFromPath(req)
+	if err != nil {
+		return "", http.StatusNotFound, err
+	}
+
+	if req.Method != http.MethodGet && department != staffDepartment {
+		return "", http.StatusForbidden, errStaffOnly
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		err := writeJSON(w, http.StatusOK, course.toJSON())
+		if err != nil {
+			return "", -1, err
+		}
+		return "", -1, nil
+	case http.MethodPut:
+		var input courseInputT
+		err := readJSON(req, &input)
+		if err != nil {
+			return "", http.StatusBadRequest, err
+		}
+		err = editCourse(req.Context(), course, input, userID)
+		if err != nil {
+			return "", courseErrorStatus(err), err
+		}
+		err = writeJSON(w, http.StatusOK, course.toJSON())
+		if err != nil {
+			return "", -1, err
+		}
+		return "", -1, nil
+	case http.MethodDelete:
+		err := retireCourse(req.Context(), course, userID)
+		if err != nil {
+			return "", courseErrorStatus(err), err
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return "", -1, nil
+	default:
+		return "", http.StatusMethodNotAllowed, errMethodNotAllowed
+	}
+}
+
+type courseStudentJSONT struct {
+	UserID     string    `json:"user_id"`
+	Name       string    `json:"name"`
+	Email      string    `json:"email"`
+	StudentID  string    `json:"student_id"`
+	Department string    `json:"year_group"`
+	Time       time.Time `json:"time"`
+}
+
+/*
+ * Staff may list the students in any course, and teachers in their own.
+ */
+func handleAPICourseStudents(w http.ResponseWriter, req *http.Request) (string, int, error) {
+	if req.Method != http.MethodGet {
+		return "", http.StatusMethodNotAllowed, errMethodNotAllowed
+	}
+
+	userID, username, department, err := getUserInfoFromRequest(req)
+	if err != nil {
+		return "", -1, err
+	}
+	if department != staffDepartment && department != teacherDepartment {
+		return "", http.StatusForbidden, errStaffOnly
+	}
+
+	course, err := loadCourseFromPath(req)
+	if err != nil {
+		return "", http.StatusNotFound, err
+	}
+	if department == teacherDepartment {
+		email, err := getUserEmail(req.Context(), userID)
+		if err != nil {
+			return "", -1, err
+		}
+		if !course.taughtBy(username, email) {
+			return "", http.StatusForbidden, errNotYourCourse
+		}
+	}
+
+	students, err := getCourseStudents(req.Context(), course.ID)
+	if err != nil {
+		return "", -1, err
+	}
+	list := make([]courseStudentJSONT, 0, len(students))
+	for _, student := range students {
+		list = append(list, courseStudentJSONT{
+			UserID:     student.UserID,
+			Name:       student.Name,
+			Email:      student.Email,
+			StudentID:  student.StudentID,
+			Department: student.Department,
+			Time:       student.Time,
+		})
+	}
+	err = writeJSON(w, http.StatusOK, list)
+	if err != nil {
+		return "", -1, err
+	}
+	return "", -1, nil
+}
+
+type studentJSONT struct {
+	ID            string         `json:"id"`
+	Name          string         `json:"name"`
+	Email         string         `json:"email"`
+	StudentID     string         `json:"student_id"`
+	Department    string         `json:"year_group"`
+	Confirmed     bool           `json:"confirmed"`
+	Status        string         `json:"status"`
+	LastLogin     *time.Time     `json:"last_login"`
+	Types         map[string]int `json:"types"`
+	MeetsMinimums bool           `json:"meets_minimums"`
+	MissingGroups []string       `json:"missing_groups"`
+}
+
+func (student *studentReportT) toJSON() studentJSONT {
+	var lastLogin *time.Time
+	if !student.LastLogin.IsZero() {
+		lastLogin = &student.LastLogin
+	}
+	return studentJSONT{
+		ID:            student.UserID,
+		Name:          student.Name,
+		Email:         student.Email,
+		StudentID:     student.StudentID,
+		Department:    student.Department,
+		Confirmed:     student.Confirmed,
+		Status:        student.status(),
+		LastLogin:     lastLogin,
+		Types:         student.Types,
+		MeetsMinimums: student.meetsMinimums(),
+		MissingGroups: student.MissingGroups,
+	}
+}
+
+/*
+ * Staff may list every student, filtered in the same way as the student
+ * report.
+ */
+func handleAPIUsers(w http.ResponseWriter, req *http.Request) (string, int, error) {
+	if req.Method != http.MethodGet {
+		return "", http.StatusMethodNotAllowed, errMethodNotAllowed
+	}
+
+	_, _, department, err := getUserInfoFromRequest(req)
+	if err != nil {
+		return "", -1, err
+	}
+	if department != staffDepartment {
+		return "", http.StatusForbidden, errStaffOnly
+	}
+
+	filter, err := studentFilterFromRequest(req)
+	if err != nil {
+		return "", http.StatusBadRequest, err
+	}
+	students, err := getStudentReport(req.Context(), filter)
+	if err != nil {
+		return "", -1, err
+	}
+	list := make([]studentJSONT, 0, len(students))
+	for _, student := range students {
+		list = append(list, student.toJSON())
+	}
+	err = writeJSON(w, http.StatusOK, list)
+	if err != nil {
+		return "", -1, err
+	}
+	return "", -1, nil
+}
+
+/*
+ * Students may only see themselves, which "me" in the path refers to, while
+ * staff may see any student. The user ID and department are those of the
+ * authenticated user. The student's department is returned too.
+ */
+func studentFromAPIPath(
+	req *http.Request,
+	userID string,
+	department string,
+) (studentID string, studentDepartment string, status int, retErr error) {
+	studentID = req.PathValue("id")
+	if studentID == "me" {
+		studentID = userID
+	}
+	if studentID != userID && department != staffDepartment {
+		return "", "", http.StatusForbidden, errStaffOnly
+	}
+	studentDepartment, err := getStudentDepartment(req.Context(), studentID)
+	if err != nil {
+		if errors.Is(err, errNoSuchStudent) {
+			return "", "", http.StatusNotFound, err
+		}
+		return "", "", -1, err
+	}
+	return studentID, studentDepartment, -1, nil
+}
+
+func handleAPIUser(w http.ResponseWriter, req *http.Request) (string, int, error) {
+	if req.Method != http.MethodGet {
+		return "", http.StatusMethodNotAllowed, errMethodNotAllowed
+	}
+
+	userID, _, department, err := getUserInfoFromRequest(req)
+	if err != nil {
+		return "", -1, err
+	}
+	studentID, _, status, err := studentFromAPIPath(req, userID, department)
+	if err != nil {
+		return "", status, err
+	}
+	students, err := getStudentReport(req.Context(), studentFilterT{UserID: studentID}) //exhaustruct:ignore
+	if err != nil {
+		return "", -1, err
+	}
+	if len(students) == 0 {
+		return "", http.StatusNotFound, wrapAny(errNoSuchStudent, studentID)
+	}
+	err = writeJSON(w, http.StatusOK, students[0].toJSON())
+	if err != nil {
+		return "", -1, err
+	}
+	return "", -1, nil
+}
+
+type choiceJSONT struct {
+	CourseID int       `json:"course"`
+	Time     time.Time `json:"time"`
+}
+
+func handleAPIChoices(w http.ResponseWriter, req *http.Request) (string, int, error) {
+	if req.Method != http.MethodGet {
+		return "", http.StatusMethodNotAllowed, errMethodNotAllowed
+	}
+
+	userID, _, department, err := getUserInfoFromRequest(req)
+	if err != nil {
+		return "", -1, err
+	}
+	studentID, _, status, err := studentFromAPIPath(req, userID, department)
+	if err != nil {
+		return "", status, err
+	}
+
+	rows, err := db.Query(
+		req.Context(),
+		"SELECT courseid, seltime FROM choices WHERE userid = $1 ORDER BY seltime",
+		studentID,
+	)
+	if err != nil {
+		return "", -1, wrapError(errUnexpectedDBError, err)
+	}
+	defer rows.Close()
+	list := make([]choiceJSONT, 0)
+	for rows.Next() {
+		var choice choiceJSONT
+		var selTime int64
+		err := rows.Scan(&choice.CourseID, &selTime)
+		if err != nil {
+			return "", -1, wrapError(errUnexpectedDBError, err)
+		}
+		choice.Time = time.UnixMicro(selTime)
+		list = append(list, choice)
+	}
+	err = rows.Err()
+	if err != nil {
+		return "", -1, wrapError(errUnexpectedDBError, err)
+	}
+
+	err = writeJSON(w, http.StatusOK, list)
+	if err != nil {
+		return "", -1, err
+	}
+	return "", -1, nil
+}
+
+/*
+ * PUT adds a course to a student's choices, and DELETE removes it, in the
+ * same way as overrides on the staff page. The body must give a reason.
+ */
+func handleAPIChoice(w http.ResponseWriter, req *http.Request) (string, int, error) {
+	if req.Method != http.MethodPut && req.Method != http.MethodDelete {
+		return "", http.StatusMethodNotAllowed, errMethodNotAllowed
+	}
+
+	userID, _, department, err := getUserInfoFromRequest(req)
+	if err != nil {
+		return "", -1, err
+	}
+	if department != staffDepartment {
+		return "", http.StatusForbidden, errStaffOnly
+	}
+	studentID, studentDepartment, status, err := studentFromAPIPath(req, userID, department)
+	if err != nil {
+		return "", status, err
+	}
+
+	courseID, err := strconv.Atoi(req.PathValue("course"))
+	if err != nil {
+		return "", http.StatusNotFound, wrapError(errNoSuchCourse, err)
+	}
+	_course, ok := courses.Load(courseID)
+	if !ok {
+		return "", http.StatusNotFound, wrapAny(errNoSuchCourse, courseID)
+	}
+	course, ok := _course.(*courseT)
+	if !ok {
+		panic("courses map has non-\"*courseT\" items")
+	}
+
+	var body struct {
+		Reason string `json:"reason"`
+		Exceed bool   `json:"exceed"`
+	}
+	err = readJSON(req, &body)
+	if err != nil {
+		return "", http.StatusBadRequest, err
+	}
+	body.Reason = strings.TrimSpace(body.Reason)
+	if body.Reason == "" {
+		return "", http.StatusBadRequest, errMissingReason
+	}
+
+	rejection, err := overrideChoice(
+		req.Context(),
+		studentID,
+		studentDepartment,
+		course,
+		req.Method == http.MethodPut,
+		body.Exceed,
+		userID,
+		body.Reason,
+	)
+	if err != nil {
+		return "", -1, err
+	}
+	if rejection != "" {
+		return "", http.StatusConflict, wrapAny(errOverrideRejected, rejection)
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return "", -1, nil
+}
+
+type stateJSONT struct {
+	State     string          `json:"state"`
+	Label     string          `json:"label"`
+	Schedules []scheduleJSONT `json:"schedules,omitempty"`
+}
+
+type scheduleJSONT struct {
+	ID    int       `json:"id"`
+	Time  time.Time `json:"time"`
+	State string    `json:"state"`
+}
+
+/*
+ * GET shows the current state, and the scheduled changes to staff, while PUT
+ * changes the state.
+ */
+func handleAPIState(w http.ResponseWriter, req *http.Request) (string, int, error) {
+	userID, _, department, err := getUserInfoFromRequest(req)
+	if err != nil {
+		return "", -1, err
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		if department != staffDepartment {
+			return "", http.StatusForbidden, errStaffOnly
+		}
+		var body struct {
+			State string `json:"state"`
+		}
+		err := readJSON(req, &body)
+		if err != nil {
+			return "", http.StatusBadRequest, err
+		}
+		newState, err := parseState(body.State)
+		if err != nil {
+			return "", http.StatusBadRequest, err
+		}
+		err = setState(req.Context(), newState, userID)
+		if err != nil {
+			return "", http.StatusBadRequest, wrapError(errCannotSetState, err)
+		}
+	default:
+		return "", http.StatusMethodNotAllowed, errMethodNotAllowed
+	}
+
+	current := getState()
+	result := stateJSONT{
+		State: current.String(),
+		Label: current.Label(),
+	} //exhaustruct:ignore
+	if department == staffDepartment {
+		schedules, err := getSchedules(req.Context())
+		if err != nil {
+			return "", -1, err
+		}
+		result.Schedules = make([]scheduleJSONT, 0, len(schedules))
+		for _, schedule := range schedules {
+			result.Schedules = append(result.Schedules, scheduleJSONT{
+				ID:    schedule.ID,
+				Time:  schedule.Time,
+				State: schedule.State.String(),
+			})
+		}
+	}
+	err = writeJSON(w, http.StatusOK, result)
+	if err != nil {
+		return "", -1, err
+	}
+	return "", -1, nil
+}
@@ -0,0 +1,134 @@
+/*
+ * Search and export the audit log
+ *
+ * Copyright (C) 2024  Runxi Yu <https://runxiyu.org>
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"net/http"
+)
+
+/*
+ * The audit page only shows this many entries; the export has all of them.
+ */
+const auditPageLimit = 500
+
+func handleAudit(w http.ResponseWriter, req *http.Request) (string, int, error) {
+	_, username, department, err := getUserInfoFromRequest(req)
+	if err != nil {
+		return "", -1, err
+	}
+	if department != staffDepartment {
+		return "", http.StatusForbidden, errStaffOnly
+	}
+
+	student := req.FormValue("student")
+	course := req.FormValue("course")
+	entries, err := searchAudit(req.Context(), student, course, auditPageLimit+1)
+	if err != nil {
+		return "", -1, err
+	}
+	truncated := len(entries) > auditPageLimit
+	if truncated {
+		entries = entries[:auditPageLimit]
+	}
+
+	err = tmpl.ExecuteTemplate(
+		w,
+		"audit",
+		struct {
+			Name      string
+			Student   string
+			Course    string
+			Entries   []auditRowT
+			Truncated bool
+		}{
+			username,
+			student,
+			course,
+			entries,
+			truncated,
+		},
+	)
+	if err != nil {
+		return "", -1, wrapError(errCannotWriteTemplate, err)
+	}
+	return "", -1, nil
+}
+
+func handleExportAudit(w http.ResponseWriter, req *http.Request) (string, int, error) {
+	_, _, department, err := getUserInfoFromRequest(req)
+	if err != nil {
+		return "", -1, err
+	}
+	if department != staffDepartment {
+		return "", http.StatusForbidden, errStaffOnly
+	}
+
+	entries, err := searchAudit(
+		req.Context(),
+		req.FormValue("student"),
+		req.FormValue("course"),
+		0,
+	)
+	if err != nil {
+		return "", -1, err
+	}
+
+	output := make([][]string, 0, len(entries))
+	for _, entry := range entries {
+		output = append(output, []string{
+			entry.Time.Format("2006-01-02 15:04:05.000000"),
+			entry.UserName,
+			entry.StudentID,
+			entry.ActorName,
+			entry.Action,
+			entry.CourseIDString(),
+			entry.CourseTitle,
+			entry.Outcome,
+			entry.Conn,
+			entry.Note,
+		})
+	}
+
+	err = writeExport(
+		w,
+		req,
+		"cca_audit",
+		[]string{
+			"Time",
+			"Student Name",
+			"Student ID",
+			"Actor",
+			"Action",
+			"Course",
+			"Course Title",
+			"Outcome",
+			"Connection",
+			"Note",
+		},
+		output,
+		-1,
+		nil,
+	)
+	if err != nil {
+		return "", -1, err
+	}
+	return "", -1, nil
+}
@@ -21,9 +21,12 @@
 package main
 
 import (
+	"crypto/subtle"
 	"errors"
-	"fmt"
 	"net/http"
+	"net/url"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/MicahParks/keyfunc/v3"
@@ -33,23 +36,25 @@ import (
 
 var myKeyfunc keyfunc.Keyfunc
 
-const tokenLength = 20
+const (
+	tokenLength = 20
+
+	/* How long a login may take at the authorize endpoint */
+	preAuthExpr = 10 * time.Minute
+)
 
 /*
- * These are the claims in the JSON Web Token received from the client, after
- * it redirects from the authorize endpoint. Some of these fields must be
- * explicitly selected in the Azure app registration and might appear as
- * zero strings if it hasn't been configured correctly.
+ * Generate the URL to the authorize endpoint, with a fresh state and nonce
+ * that are remembered in the pre-auth cookie until the user returns to
+ * /auth. The state protects /auth against cross-site request forgery, while
+ * the nonce ties the ID token to this login and prevents it from being
+ * replayed.
  */
-type msclaimsT struct {
-	Name   string   `json:"name"`
-	Email  string   `json:"email"`
-	Oid    string   `json:"oid"`
-	Groups []string `json:"groups"`
-	jwt.RegisteredClaims
-}
-
-func generateAuthorizationURL() (string, error) {
+func generateAuthorizationURL(w http.ResponseWriter) (string, error) {
+	state, err := randomString(tokenLength)
+	if err != nil {
+		return "", err
+	}
 	nonce, err := randomString(tokenLength)
 	if err != nil {
 		return "", err
@@ -65,12 +70,95 @@ func generateAuthorizationURL() (string, error) {
 	 * obtain an access code to call the user info endpoint to fetch the
 	 * user's department information.
 	 */
-	return fmt.Sprintf(
-		"https://login.microsoftonline.com/ddd3d26c-b197-4d00-a32d-1ffd84c0c295/oauth2/authorize?client_id=%s&response_type=id_token%%20code&redirect_uri=%s%%2Fauth&response_mode=form_post&scope=openid+profile+email+User.Read&nonce=%s",
-		config.Auth.Client,
-		config.URL,
-		nonce,
-	), nil
+	authorizeURL, err := url.Parse(config.Auth.Authorize)
+	if err != nil {
+		return "", wrapError(errInvalidConfigValue, err)
+	}
+	query := authorizeURL.Query()
+	query.Set("client_id", config.Auth.Client)
+	query.Set("response_type", config.Auth.ResponseType)
+	query.Set("redirect_uri", config.URL+"/auth")
+	query.Set("response_mode", "form_post")
+	query.Set("scope", config.Auth.Scope)
+	query.Set("state", state)
+	query.Set("nonce", nonce)
+	authorizeURL.RawQuery = query.Encode()
+
+	/*
+	 * The authorize endpoint returns with a cross-site POST, for which
+	 * browsers only send cookies with SameSite=None, which in turn must be
+	 * Secure. Browsers accept Secure cookies over plain HTTP on localhost,
+	 * which is the only place where plain HTTP is usable anyway.
+	 */
+	http.SetCookie(w, &http.Cookie{
+		Name:     "preauth",
+		Value:    state + "." + nonce,
+		Path:     "/auth",
+		SameSite: http.SameSiteNoneMode,
+		HttpOnly: true,
+		Secure:   true,
+		MaxAge:   int(preAuthExpr / time.Second),
+	}) //exhaustruct:ignore
+
+	return authorizeURL.String(), nil
+}
+
+/*
+ * Read and clear the pre-auth cookie set by generateAuthorizationURL.
+ */
+func consumePreAuthCookie(w http.ResponseWriter, req *http.Request) (state, nonce string, err error) {
+	cookie, err := req.Cookie("preauth")
+	if errors.Is(err, http.ErrNoCookie) {
+		return "", "", errNoPreAuthCookie
+	} else if err != nil {
+		return "", "", wrapError(errCannotCheckCookie, err)
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     "preauth",
+		Path:     "/auth",
+		SameSite: http.SameSiteNoneMode,
+		HttpOnly: true,
+		Secure:   true,
+		MaxAge:   -1,
+	}) //exhaustruct:ignore
+
+	state, nonce, ok := strings.Cut(cookie.Value, ".")
+	if !ok || state == "" || nonce == "" {
+		return "", "", errNoPreAuthCookie
+	}
+	return state, nonce, nil
+}
+
+/*
+ * Check that the ID token was issued by the configured issuer for this
+ * client, and in response to the login started with the nonce. The
+ * signature and expiry are checked when the token is parsed.
+ */
+func checkIDTokenClaims(mapClaims jwt.MapClaims, expectedNonce string) error {
+	nonce, _ := mapClaims["nonce"].(string)
+	if !secretsEqual(nonce, expectedNonce) {
+		return errInvalidNonce
+	}
+
+	audience, err := mapClaims.GetAudience()
+	if err != nil || !slices.Contains(audience, config.Auth.Client) {
+		return errInvalidAudience
+	}
+
+	issuer, err := mapClaims.GetIssuer()
+	if err != nil || strings.TrimSuffix(issuer, "/") != config.Auth.Issuer {
+		return errInvalidIssuer
+	}
+
+	return nil
+}
+
+/*
+ * Compare two secrets without leaking where they differ through timing.
+ */
+func secretsEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
 }
 
 /*
@@ -88,6 +176,15 @@ func handleAuth(w http.ResponseWriter, req *http.Request) (string, int, error) {
 		return "", http.StatusBadRequest, wrapError(errMalformedForm, err)
 	}
 
+	expectedState, expectedNonce, err := consumePreAuthCookie(w, req)
+	if err != nil {
+		return "", http.StatusBadRequest, err
+	}
+
+	if !secretsEqual(req.PostFormValue("state"), expectedState) {
+		return "", http.StatusBadRequest, errInvalidOIDCState
+	}
+
 	returnedError := req.PostFormValue("error")
 	if returnedError != "" {
 		returnedErrorDescription := req.PostFormValue("error_description")
@@ -105,10 +202,9 @@ func handleAuth(w http.ResponseWriter, req *http.Request) (string, int, error) {
 		)
 	}
 
-	claimsTemplate := &msclaimsT{} //exhaustruct:ignore
 	token, err := jwt.ParseWithClaims(
 		idTokenString,
-		claimsTemplate,
+		jwt.MapClaims{},
 		myKeyfunc.Keyfunc,
 	)
 	if err != nil {
@@ -144,15 +240,25 @@ func handleAuth(w http.ResponseWriter, req *http.Request) (string, int, error) {
 		)
 	}
 
-	claims, claimsOk := token.Claims.(*msclaimsT)
+	mapClaims, claimsOk := token.Claims.(jwt.MapClaims)
 
 	if !claimsOk {
 		return "", http.StatusBadRequest, errCannotUnpackClaims
 	}
 
+	err = checkIDTokenClaims(mapClaims, expectedNonce)
+	if err != nil {
+		return "", http.StatusBadRequest, err
+	}
+
+	claims, err := getUserClaims(mapClaims)
+	if err != nil {
+		return "", http.StatusBadRequest, err
+	}
+
 	var department string
 	var ok bool
-	department, ok = getDepartmentByUserIDOverride(claims.Oid)
+	department, ok = getDepartmentByUserIDOverride(claims.ID)
 	if !ok {
 		department, ok = getDepartmentByGroups(claims.Groups)
 		if !ok {
@@ -160,48 +266,31 @@ func handleAuth(w http.ResponseWriter, req *http.Request) (string, int, error) {
 		}
 	}
 
-	cookieValue, err := randomString(tokenLength)
+	err = adoptRosterUser(req.Context(), claims.ID, claims.Email)
 	if err != nil {
 		return "", -1, err
 	}
 
-	now := time.Now()
-	expr := now.Add(time.Duration(config.Auth.Expr) * time.Second)
-	exprU := expr.Unix()
-
-	cookie := http.Cookie{
-		Name:     "session",
-		Value:    cookieValue,
-		SameSite: http.SameSiteLaxMode,
-		HttpOnly: true,
-		Secure:   config.Prod,
-		Expires:  expr,
-	} //exhaustruct:ignore
-
-	http.SetCookie(w, &cookie)
-
 	_, err = db.Exec(
 		req.Context(),
-		"INSERT INTO users (id, name, email, department, session, expr, confirmed) VALUES ($1, $2, $3, $4, $5, $6, false)",
-		claims.Oid,
+		"INSERT INTO users (id, name, email, department, confirmed, lastlogin) VALUES ($1, $2, $3, $4, false, $5)",
+		claims.ID,
 		claims.Name,
 		claims.Email,
 		department,
-		cookieValue,
-		exprU,
+		time.Now().Unix(),
 	)
 	if err != nil {
 		var pgErr *pgconn.PgError
 		if errors.As(err, &pgErr) && pgErr.Code == pgErrUniqueViolation {
 			_, err := db.Exec(
 				req.Context(),
-				"UPDATE users SET (name, email, department, session, expr) = ($1, $2, $3, $4, $5) WHERE id = $6",
+				"UPDATE users SET (name, email, department, lastlogin) = ($1, $2, $3, $4) WHERE id = $5",
 				claims.Name,
 				claims.Email,
 				department,
-				cookieValue,
-				exprU,
-				claims.Oid,
+				time.Now().Unix(),
+				claims.ID,
 			)
 			if err != nil {
 				return "", -1, wrapError(errUnexpectedDBError, err)
@@ -211,6 +300,11 @@ func handleAuth(w http.ResponseWriter, req *http.Request) (string, int, error) {
 		}
 	}
 
+	err = createSession(w, req, claims.ID)
+	if err != nil {
+		return "", -1, err
+	}
+
 	http.Redirect(w, req, "/", http.StatusSeeOther)
 
 	return "", -1, nil
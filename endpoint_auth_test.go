@@ -0,0 +1,113 @@
+/*
+ * Tests for logging in
+ *
+ * Copyright (C) 2024  Runxi Yu <https://runxiyu.org>
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestHandleAuthState(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		cookie  string /* empty for no preauth cookie */
+		state   string
+		wantErr error
+	}{
+		{"no cookie", "", "state", errNoPreAuthCookie},
+		{"malformed cookie", "state", "state", errNoPreAuthCookie},
+		{"empty nonce", "state.", "state", errNoPreAuthCookie},
+		{"wrong state", "state.nonce", "other", errInvalidOIDCState},
+		{"missing state", "state.nonce", "", errInvalidOIDCState},
+		{"state of another login", "state.nonce", "nonce", errInvalidOIDCState},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			form := url.Values{"state": {test.state}, "id_token": {"x"}}
+			req := httptest.NewRequest(http.MethodPost, "/auth", strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			if test.cookie != "" {
+				req.AddCookie(&http.Cookie{Name: "preauth", Value: test.cookie}) //exhaustruct:ignore
+			}
+			_, status, err := handleAuth(httptest.NewRecorder(), req)
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("got error %v, want %v", err, test.wantErr)
+			}
+			if status != http.StatusBadRequest {
+				t.Errorf("got status %d, want %d", status, http.StatusBadRequest)
+			}
+		})
+	}
+}
+
+func TestCheckIDTokenClaims(t *testing.T) {
+	config.Auth.Client = "client"
+	config.Auth.Issuer = "https://login.example.org/tenant/v2.0"
+
+	valid := func() jwt.MapClaims {
+		return jwt.MapClaims{
+			"nonce": "nonce",
+			"aud":   "client",
+			"iss":   "https://login.example.org/tenant/v2.0",
+		}
+	}
+
+	tests := []struct {
+		name    string
+		modify  func(jwt.MapClaims)
+		wantErr error
+	}{
+		{"valid", func(jwt.MapClaims) {}, nil},
+		{"issuer with trailing slash", func(c jwt.MapClaims) { c["iss"] = "https://login.example.org/tenant/v2.0/" }, nil},
+		{"audience list", func(c jwt.MapClaims) { c["aud"] = []any{"other", "client"} }, nil},
+		{"wrong nonce", func(c jwt.MapClaims) { c["nonce"] = "other" }, errInvalidNonce},
+		{"missing nonce", func(c jwt.MapClaims) { delete(c, "nonce") }, errInvalidNonce},
+		{"non-string nonce", func(c jwt.MapClaims) { c["nonce"] = 1 }, errInvalidNonce},
+		{"wrong audience", func(c jwt.MapClaims) { c["aud"] = "other" }, errInvalidAudience},
+		{"audience list without client", func(c jwt.MapClaims) { c["aud"] = []any{"other"} }, errInvalidAudience},
+		{"missing audience", func(c jwt.MapClaims) { delete(c, "aud") }, errInvalidAudience},
+		{"other tenant", func(c jwt.MapClaims) { c["iss"] = "https://login.example.org/other/v2.0" }, errInvalidIssuer},
+		{"missing issuer", func(c jwt.MapClaims) { delete(c, "iss") }, errInvalidIssuer},
+		{"non-string issuer", func(c jwt.MapClaims) { c["iss"] = 1 }, errInvalidIssuer},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			claims := valid()
+			test.modify(claims)
+			err := checkIDTokenClaims(claims, "nonce")
+			if !errors.Is(err, test.wantErr) {
+				t.Errorf("got error %v, want %v", err, test.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,113 @@
+/*
+ * Show and export the students in a course
+ *
+ * Copyright (C) 2024  Runxi Yu <https://runxiyu.org>
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"net/http"
+	"strconv"
+)
+
+/*
+ * Teachers may only see their own courses, while staff may see every course.
+ * The list is exported instead if the "format" query parameter is "csv" or
+ * "xlsx".
+ */
+func handleCourseStudents(w http.ResponseWriter, req *http.Request) (string, int, error) {
+	userID, username, department, err := getUserInfoFromRequest(req)
+	if err != nil {
+		return "", -1, err
+	}
+	if department != staffDepartment && department != teacherDepartment {
+		return "", http.StatusForbidden, errStaffOnly
+	}
+
+	course, err := loadCourseFromPath(req)
+	if err != nil {
+		return "", http.StatusNotFound, err
+	}
+
+	if department == teacherDepartment {
+		email, err := getUserEmail(req.Context(), userID)
+		if err != nil {
+			return "", -1, err
+		}
+		if !course.taughtBy(username, email) {
+			return "", http.StatusForbidden, errNotYourCourse
+		}
+	}
+
+	students, err := getCourseStudents(req.Context(), course.ID)
+	if err != nil {
+		return "", -1, err
+	}
+
+	if req.FormValue("format") != "" {
+		output := make([][]string, 0, len(students))
+		for _, student := range students {
+			output = append(output, []string{
+				student.Name,
+				student.StudentID,
+				student.Email,
+				student.Department,
+				student.Time.Format("2006-01-02 15:04:05"),
+			})
+		}
+		err = writeExport(
+			w,
+			req,
+			"cca_course_"+strconv.Itoa(course.ID),
+			[]string{
+				"Student Name",
+				"Student ID",
+				"Email",
+				"Grade/Year",
+				"Selection Time",
+			},
+			output,
+			-1,
+			nil,
+		)
+		if err != nil {
+			return "", -1, err
+		}
+		return "", -1, nil
+	}
+
+	err = tmpl.ExecuteTemplate(
+		w,
+		"course_students",
+		struct {
+			Name     string
+			Staff    bool
+			Course   courseJSONT
+			Students []courseStudentT
+		}{
+			username,
+			department == staffDepartment,
+			course.toJSON(),
+			students,
+		},
+	)
+	if err != nil {
+		return "", -1, wrapError(errCannotWriteTemplate, err)
+	}
+	return "", -1, nil
+}
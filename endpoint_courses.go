@@ -0,0 +1,208 @@
+/*
+ * Add, edit and retire individual courses
+ *
+ * Copyright (C) 2024  Runxi Yu <https://runxiyu.org>
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+/*
+ * Read a course from the course form. Scripts use the JSON API instead.
+ */
+func readCourseInput(req *http.Request) (courseInputT, error) {
+	var input courseInputT
+	nmax, err := strconv.ParseUint(req.FormValue("max"), 10, 32)
+	if err != nil {
+		return input, wrapAny(errInvalidCourse, "invalid max")
+	}
+	eligible, err := parseEligible(req.FormValue("eligible"))
+	if err != nil {
+		return input, err
+	}
+	input = courseInputT{
+		Title:        req.FormValue("title"),
+		Max:          uint32(nmax),
+		Teacher:      req.FormValue("teacher"),
+		TeacherEmail: strings.TrimSpace(req.FormValue("teacher_email")),
+		Location:     req.FormValue("location"),
+		Type:         req.FormValue("type"),
+		Group:        req.FormValue("group"),
+		CourseID:     req.FormValue("course_id"),
+		SectionID:    req.FormValue("section_id"),
+		Eligible:     eligible,
+	}
+	return input, nil
+}
+
+func loadCourseFromPath(req *http.Request) (*courseT, error) {
+	_courseID, err := strconv.ParseInt(req.PathValue("id"), 10, strconv.IntSize)
+	if err != nil {
+		return nil, wrapError(errNoSuchCourse, err)
+	}
+	courseID := int(_courseID)
+	_course, ok := courses.Load(courseID)
+	if !ok {
+		return nil, wrapAny(errNoSuchCourse, courseID)
+	}
+	course, ok := _course.(*courseT)
+	if !ok {
+		panic("courses map has non-\"*courseT\" items")
+	}
+	if course == nil {
+		return nil, wrapAny(errNoSuchCourse, courseID)
+	}
+	return course, nil
+}
+
+func writeCourseForm(w http.ResponseWriter, username string, course *courseJSONT) error {
+	err := tmpl.ExecuteTemplate(
+		w,
+		"course",
+		struct {
+			Name   string
+			Course *courseJSONT
+			Types  []courseTypeT
+			Groups []courseGroupT
+		}{
+			username,
+			course,
+			config.Types,
+			getCourseGroups(),
+		},
+	)
+	if err != nil {
+		return wrapError(errCannotWriteTemplate, err)
+	}
+	return nil
+}
+
+/*
+ * Add a course from the form at /courses/new.
+ */
+func handleCourses(w http.ResponseWriter, req *http.Request) (string, int, error) {
+	if req.Method != http.MethodPost {
+		return "", http.StatusMethodNotAllowed, errPostOnly
+	}
+
+	userID, _, department, err := getUserInfoFromRequest(req)
+	if err != nil {
+		return "", -1, err
+	}
+	if department != staffDepartment {
+		return "", http.StatusForbidden, errStaffOnly
+	}
+
+	input, err := readCourseInput(req)
+	if err != nil {
+		return "", http.StatusBadRequest, err
+	}
+	_, err = addCourse(req.Context(), input, userID)
+	if err != nil {
+		return "", courseErrorStatus(err), err
+	}
+	http.Redirect(w, req, "/", http.StatusSeeOther)
+	return "", -1, nil
+}
+
+func handleNewCourseForm(w http.ResponseWriter, req *http.Request) (string, int, error) {
+	_, username, department, err := getUserInfoFromRequest(req)
+	if err != nil {
+		return "", -1, err
+	}
+	if department != staffDepartment {
+		return "", http.StatusForbidden, errStaffOnly
+	}
+
+	err = writeCourseForm(w, username, nil)
+	if err != nil {
+		return "", -1, err
+	}
+	return "", -1, nil
+}
+
+/*
+ * GET shows a form for editing the course, while POST edits it.
+ */
+func handleCourse(w http.ResponseWriter, req *http.Request) (string, int, error) {
+	userID, username, department, err := getUserInfoFromRequest(req)
+	if err != nil {
+		return "", -1, err
+	}
+	if department != staffDepartment {
+		return "", http.StatusForbidden, errStaffOnly
+	}
+
+	course, err := loadCourseFromPath(req)
+	if err != nil {
+		return "", http.StatusNotFound, err
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		courseJSON := course.toJSON()
+		err = writeCourseForm(w, username, &courseJSON)
+		if err != nil {
+			return "", -1, err
+		}
+		return "", -1, nil
+	case http.MethodPost:
+		input, err := readCourseInput(req)
+		if err != nil {
+			return "", http.StatusBadRequest, err
+		}
+		err = editCourse(req.Context(), course, input, userID)
+		if err != nil {
+			return "", courseErrorStatus(err), err
+		}
+		http.Redirect(w, req, "/", http.StatusSeeOther)
+		return "", -1, nil
+	default:
+		return "", http.StatusMethodNotAllowed, errMethodNotAllowed
+	}
+}
+
+func handleRetireCourse(w http.ResponseWriter, req *http.Request) (string, int, error) {
+	if req.Method != http.MethodPost {
+		return "", http.StatusMethodNotAllowed, errPostOnly
+	}
+
+	userID, _, department, err := getUserInfoFromRequest(req)
+	if err != nil {
+		return "", -1, err
+	}
+	if department != staffDepartment {
+		return "", http.StatusForbidden, errStaffOnly
+	}
+
+	course, err := loadCourseFromPath(req)
+	if err != nil {
+		return "", http.StatusNotFound, err
+	}
+
+	err = retireCourse(req.Context(), course, userID)
+	if err != nil {
+		return "", courseErrorStatus(err), err
+	}
+	http.Redirect(w, req, "/", http.StatusSeeOther)
+	return "", -1, nil
+}
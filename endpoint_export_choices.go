@@ -21,9 +21,7 @@
 package main
 
 import (
-	"encoding/csv"
 	"net/http"
-	"strings"
 )
 
 func handleExportChoices(w http.ResponseWriter, req *http.Request) (string, int, error) {
@@ -70,22 +68,18 @@ func handleExportChoices(w http.ResponseWriter, req *http.Request) (string, int,
 			var currentUserEmail string
 			err := db.QueryRow(
 				req.Context(),
-				"SELECT name, email, department FROM users WHERE id = $1",
+				"SELECT name, email, COALESCE(student_id, ''), department FROM users WHERE id = $1",
 				currentUserID,
 			).Scan(
 				&currentUserName,
 				&currentUserEmail,
+				&currentStudentID,
 				&currentDepartment,
 			)
 			if err != nil {
 				return "", -1, wrapError(errUnexpectedDBError, err)
 			}
-			before, _, found := strings.Cut(currentUserEmail, "@")
-			if found {
-				currentStudentID, _ = strings.CutPrefix(before, "s")
-			} else {
-				currentStudentID = currentUserEmail
-			}
+			currentStudentID = studentIDOf(currentStudentID, currentUserEmail)
 			userCacheMap[currentUserID] = userCacheT{
 				Name:       currentUserName,
 				StudentID:  currentStudentID,
@@ -104,42 +98,42 @@ func handleExportChoices(w http.ResponseWriter, req *http.Request) (string, int,
 		if course == nil {
 			return "", -1, wrapAny(errNoSuchCourse, currentCourseID)
 		}
+		info := course.Info()
 		output = append(
 			output,
 			[]string{
 				currentUserName,
 				currentStudentID,
 				currentDepartment,
-				course.Title,
-				course.Group,
-				course.SectionID,
-				course.CourseID,
+				info.Title,
+				info.Group,
+				info.SectionID,
+				info.CourseID,
+				info.EligibleString(),
 			},
 		)
 	}
 
-	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
-	w.Header().Set("Content-Disposition", "attachment;filename=cca_choices.csv")
-	csvWriter := csv.NewWriter(w)
-	err = csvWriter.Write([]string{
-		"Student Name",
-		"Student ID",
-		"Grade/Year",
-		"Group/Activity",
-		"Container",
-		"Section ID",
-		"Course ID",
-	})
-	if err != nil {
-		return "", -1, wrapError(errHTTPWrite, err)
-	}
-	err = csvWriter.WriteAll(output)
+	err = writeExport(
+		w,
+		req,
+		"cca_choices",
+		[]string{
+			"Student Name",
+			"Student ID",
+			"Grade/Year",
+			"Group/Activity",
+			"Container",
+			"Section ID",
+			"Course ID",
+			"Eligible Year Groups",
+		},
+		output,
+		4,
+		getCourseGroupHandles(),
+	)
 	if err != nil {
-		return "", -1, wrapError(errHTTPWrite, err)
-	}
-	csvWriter.Flush()
-	if csvWriter.Error() != nil {
-		return "", -1, wrapError(errHTTPWrite, err)
+		return "", -1, err
 	}
 	return "", -1, nil
 }
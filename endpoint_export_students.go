@@ -1,5 +1,5 @@
 /*
- * Staff page
+ * Export the status of every student
  *
  * Copyright (C) 2024  Runxi Yu <https://runxiyu.org>
  * SPDX-License-Identifier: AGPL-3.0-or-later
@@ -21,83 +21,105 @@
 package main
 
 import (
-	"encoding/csv"
 	"net/http"
 	"strconv"
+	"strings"
 )
 
+/*
+ * The "year" query parameter limits the students to a year group, and the
+ * "confirmed" and "loggedin" query parameters to students who have or have
+ * not confirmed their choices or logged in.
+ */
+func studentFilterFromRequest(req *http.Request) (studentFilterT, error) {
+	var filters [2]*bool
+	for i, name := range []string{"confirmed", "loggedin"} {
+		if req.FormValue(name) == "" {
+			continue
+		}
+		v, err := strconv.ParseBool(req.FormValue(name))
+		if err != nil {
+			return studentFilterT{}, wrapError(errInvalidFilter, err) //exhaustruct:ignore
+		}
+		filters[i] = &v
+	}
+	return studentFilterT{
+		YearGroup: req.FormValue("year"),
+		Confirmed: filters[0],
+		LoggedIn:  filters[1],
+	}, nil //exhaustruct:ignore
+}
+
+/*
+ * Export the status of every student matching the filters in the query.
+ */
 func handleExportStudents(w http.ResponseWriter, req *http.Request) (string, int, error) {
 	_, _, department, err := getUserInfoFromRequest(req)
 	if err != nil {
 		return "", -1, err
 	}
 	if department != staffDepartment {
-		return "", -1, errStaffOnly
+		return "", http.StatusForbidden, errStaffOnly
 	}
 
-	rows, err := db.Query(req.Context(), "SELECT name, email, department, confirmed FROM users")
+	filter, err := studentFilterFromRequest(req)
 	if err != nil {
-		return "", -1, wrapError(errUnexpectedDBError, err)
+		return "", http.StatusBadRequest, err
 	}
-	output := make([][]string, 0)
-	for {
-		if !rows.Next() {
-			err := rows.Err()
-			if err != nil {
-				return "", -1, wrapError(errUnexpectedDBError, err)
-			}
-			break
-		}
-		var currentUserName, currentEmail, currentDepartment string
-		var currentConfirmed bool
-		err := rows.Scan(
-			&currentUserName,
-			&currentEmail,
-			&currentDepartment,
-			&currentConfirmed,
-		)
-		if err != nil {
-			return "", -1, wrapError(errUnexpectedDBError, err)
-		}
 
-		if currentDepartment == staffDepartment {
-			continue
-		}
-
-		output = append(
-			output,
-			[]string{
-				currentUserName,
-				currentEmail,
-				currentDepartment,
-				strconv.FormatBool(currentConfirmed),
-			},
-		)
+	students, err := getStudentReport(req.Context(), filter)
+	if err != nil {
+		return "", -1, err
 	}
 
-	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
-	w.Header().Set("Content-Disposition", "attachment;filename=cca_students.csv")
-	csvWriter := csv.NewWriter(w)
-	err = csvWriter.Write([]string{
+	courseTypes := getCourseTypeHandles()
+	header := []string{
 		"Student Name",
 		"Student ID",
+		"Email",
 		"Grade/Year",
-		"Group/Activity",
-		"Container",
-		"Section ID",
-		"Course ID",
-	})
-	if err != nil {
-		return "", -1, errHTTPWrite
+		"Confirmed",
+		"Status",
 	}
-	err = csvWriter.WriteAll(output)
-	if err != nil {
-		return "", -1, errHTTPWrite
+	for _, courseType := range courseTypes {
+		header = append(header, courseType, courseType+" Minimum")
 	}
-	csvWriter.Flush()
-	if csvWriter.Error() != nil {
-		return "", -1, errHTTPWrite
+	header = append(header, "Meets Minimums", "Missing Groups", "Last Login")
+
+	output := make([][]string, 0, len(students))
+	for _, student := range students {
+		row := []string{
+			student.Name,
+			student.StudentID,
+			student.Email,
+			student.Department,
+			strconv.FormatBool(student.Confirmed),
+			student.status(),
+		}
+		for _, courseType := range courseTypes {
+			minimum := ""
+			requirement, err := getCourseTypeRequirementForYearGroup(student.Department, courseType)
+			if err == nil {
+				minimum = strconv.Itoa(requirement.Min)
+			}
+			row = append(row, strconv.Itoa(student.Types[courseType]), minimum)
+		}
+		lastLogin := ""
+		if !student.LastLogin.IsZero() {
+			lastLogin = student.LastLogin.Format("2006-01-02 15:04:05")
+		}
+		row = append(
+			row,
+			strconv.FormatBool(student.meetsMinimums()),
+			strings.Join(student.MissingGroups, " "),
+			lastLogin,
+		)
+		output = append(output, row)
 	}
 
+	err = writeExport(w, req, "cca_students", header, output, 3, getYearGroups())
+	if err != nil {
+		return "", -1, err
+	}
 	return "", -1, nil
 }
@@ -0,0 +1,124 @@
+/*
+ * Export waitlists as a spreadsheet
+ *
+ * Copyright (C) 2024  Runxi Yu <https://runxiyu.org>
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"net/http"
+	"strconv"
+)
+
+func handleExportWaitlist(w http.ResponseWriter, req *http.Request) (string, int, error) {
+	_, _, department, err := getUserInfoFromRequest(req)
+	if err != nil {
+		return "", -1, err
+	}
+	if department != staffDepartment {
+		return "", http.StatusForbidden, errStaffOnly
+	}
+
+	lengths, err := getWaitlistLengths(req.Context())
+	if err != nil {
+		return "", -1, err
+	}
+
+	rows, err := db.Query(
+		req.Context(),
+		"SELECT u.name, u.email, COALESCE(u.student_id, ''), u.department, w.courseid, ROW_NUMBER() OVER (PARTITION BY w.courseid ORDER BY w.jointime) FROM waitlist w JOIN users u ON u.id = w.userid ORDER BY w.courseid, w.jointime",
+	)
+	if err != nil {
+		return "", -1, wrapError(errUnexpectedDBError, err)
+	}
+	output := make([][]string, 0)
+	for {
+		if !rows.Next() {
+			err := rows.Err()
+			if err != nil {
+				return "", -1, wrapError(errUnexpectedDBError, err)
+			}
+			break
+		}
+		var currentUserName, currentEmail, currentDepartment, currentStudentID string
+		var currentCourseID, currentPosition int
+		err := rows.Scan(
+			&currentUserName,
+			&currentEmail,
+			&currentStudentID,
+			&currentDepartment,
+			&currentCourseID,
+			&currentPosition,
+		)
+		if err != nil {
+			return "", -1, wrapError(errUnexpectedDBError, err)
+		}
+		currentStudentID = studentIDOf(currentStudentID, currentEmail)
+
+		_course, ok := courses.Load(currentCourseID)
+		if !ok {
+			return "", -1, wrapAny(errNoSuchCourse, currentCourseID)
+		}
+		course, ok := _course.(*courseT)
+		if !ok {
+			panic("courses map has non-\"*courseT\" items")
+		}
+		if course == nil {
+			return "", -1, wrapAny(errNoSuchCourse, currentCourseID)
+		}
+		info := course.Info()
+		output = append(
+			output,
+			[]string{
+				currentUserName,
+				currentStudentID,
+				currentDepartment,
+				info.Title,
+				info.Group,
+				info.SectionID,
+				info.CourseID,
+				strconv.Itoa(currentPosition),
+				strconv.Itoa(lengths[currentCourseID]),
+			},
+		)
+	}
+
+	err = writeExport(
+		w,
+		req,
+		"cca_waitlist",
+		[]string{
+			"Student Name",
+			"Student ID",
+			"Grade/Year",
+			"Group/Activity",
+			"Container",
+			"Section ID",
+			"Course ID",
+			"Position",
+			"Waitlist Length",
+		},
+		output,
+		-1,
+		nil,
+	)
+	if err != nil {
+		return "", -1, err
+	}
+	return "", -1, nil
+}
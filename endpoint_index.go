@@ -22,14 +22,14 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"net/http"
-	"sync/atomic"
 )
 
 func handleIndex(w http.ResponseWriter, req *http.Request) (string, int, error) {
-	_, username, department, err := getUserInfoFromRequest(req)
+	userID, username, department, err := getUserInfoFromRequest(req)
 	if errors.Is(err, errNoCookie) || errors.Is(err, errNoSuchUser) {
-		authURL, err2 := generateAuthorizationURL()
+		authURL, err2 := generateAuthorizationURL(w)
 		if err2 != nil {
 			return "", -1, err2
 		}
@@ -56,46 +56,55 @@ func handleIndex(w http.ResponseWriter, req *http.Request) (string, int, error)
 		return "", -1, err
 	}
 
-	/* TODO: The below should be completed on-update. */
-	type groupT struct {
-		Handle  string
-		Name    string
-		Courses *map[int]*courseT
+	groups, err := getTemplateGroups()
+	if err != nil {
+		return "", -1, err
 	}
-	_groups := make(map[string]groupT)
-	for k, v := range courseGroups {
-		_coursemap := make(map[int]*courseT)
-		_groups[k] = groupT{
-			Handle:  k,
-			Name:    v,
-			Courses: &_coursemap,
+
+	if department == staffDepartment {
+		waiting, err := getWaitlistLengths(req.Context())
+		if err != nil {
+			return "", -1, err
 		}
-	}
-	courses.Range(func(key, value interface{}) bool {
-		courseID, ok := key.(int)
-		if !ok {
-			panic("courses map has non-\"int\" keys")
+		schedules, err := getSchedules(req.Context())
+		if err != nil {
+			return "", -1, err
 		}
-		course, ok := value.(*courseT)
-		if !ok {
-			panic("courses map has non-\"*courseT\" items")
+		history, err := getStateHistory(req.Context())
+		if err != nil {
+			return "", -1, err
 		}
-		(*_groups[course.Group].Courses)[courseID] = course
-		return true
-	})
-
-	if department == staffDepartment {
-		err := tmpl.ExecuteTemplate(
+		tokens, err := getAPITokens(req.Context())
+		if err != nil {
+			return "", -1, err
+		}
+		err = tmpl.ExecuteTemplate(
 			w,
 			"staff",
 			struct {
-				Name   string
-				State  uint32
-				Groups *map[string]groupT
+				Name      string
+				State     stateT
+				States    []stateT
+				History   []stateHistoryT
+				Groups    []templateGroupT
+				Waiting   map[int]int
+				Lottery   bool
+				Schedules []scheduleT
+				Years     []string
+				Tokens    []apiTokenT
+				Scopes    []string
 			}{
 				username,
-				state,
-				&_groups,
+				getState(),
+				states,
+				history,
+				groups,
+				waiting,
+				config.Mode == selectionModeLottery,
+				schedules,
+				getYearGroups(),
+				tokens,
+				apiTokenScopes,
 			},
 		)
 		if err != nil {
@@ -104,16 +113,20 @@ func handleIndex(w http.ResponseWriter, req *http.Request) (string, int, error)
 		return "", -1, nil
 	}
 
-	if atomic.LoadUint32(&state) == 0 {
-		err := tmpl.ExecuteTemplate(
+	if department == teacherDepartment {
+		email, err := getUserEmail(req.Context(), userID)
+		if err != nil {
+			return "", -1, err
+		}
+		err = tmpl.ExecuteTemplate(
 			w,
-			"student_disabled",
+			"teacher",
 			struct {
-				Name       string
-				Department string
+				Name    string
+				Courses []*courseT
 			}{
 				username,
-				department,
+				getCoursesTaughtBy(username, email),
 			},
 		)
 		if err != nil {
@@ -121,13 +134,123 @@ func handleIndex(w http.ResponseWriter, req *http.Request) (string, int, error)
 		}
 		return "", -1, nil
 	}
-	sportRequired, err := getCourseTypeMinimumForYearGroup(department, sport)
+
+	err = writeStudentPage(w, username, department, groups, "", "")
 	if err != nil {
 		return "", -1, err
 	}
-	nonSportRequired, err := getCourseTypeMinimumForYearGroup(department, nonSport)
+	return "", -1, nil
+}
+
+type templateGroupT struct {
+	Handle  string
+	Name    string
+	Courses *map[int]*courseT
+}
+
+/*
+ * Courses in groups that don't exist are reported as an error rather than
+ * hidden, as they would otherwise silently disappear from the student page.
+ * setupCourseGroups refuses to remove groups that courses are still in.
+ *
+ * TODO: This should be completed on-update.
+ */
+func getTemplateGroups() ([]templateGroupT, error) {
+	courseGroupList := getCourseGroups()
+	_groups := make([]templateGroupT, 0, len(courseGroupList))
+	_groupIndices := make(map[string]int, len(courseGroupList))
+	for _, g := range courseGroupList {
+		_coursemap := make(map[int]*courseT)
+		_groupIndices[g.Handle] = len(_groups)
+		_groups = append(_groups, templateGroupT{
+			Handle:  g.Handle,
+			Name:    g.Name,
+			Courses: &_coursemap,
+		})
+	}
+	var err error
+	courses.Range(func(key, value interface{}) bool {
+		courseID, ok := key.(int)
+		if !ok {
+			panic("courses map has non-\"int\" keys")
+		}
+		course, ok := value.(*courseT)
+		if !ok {
+			panic("courses map has non-\"*courseT\" items")
+		}
+		i, ok := _groupIndices[course.Info().Group]
+		if !ok {
+			err = wrapAny(
+				errCourseGroupHandlingError,
+				fmt.Sprintf("course %d is in non-existent group %q", courseID, course.Info().Group),
+			)
+			return false
+		}
+		(*_groups[i].Courses)[courseID] = course
+		return true
+	})
 	if err != nil {
-		return "", -1, err
+		return nil, err
+	}
+	return _groups, nil
+}
+
+/*
+ * Write the student page, or the page shown to students while student access
+ * is disabled. If a staff member is managing the student's choices, as is the
+ * student's user ID and manager is the staff member's name; otherwise both
+ * are empty.
+ */
+func writeStudentPage(
+	w http.ResponseWriter,
+	name string,
+	department string,
+	groups []templateGroupT,
+	as string,
+	manager string,
+) error {
+	if getState() == stateDisabled {
+		err := tmpl.ExecuteTemplate(
+			w,
+			"student_disabled",
+			struct {
+				Name       string
+				Department string
+			}{
+				name,
+				department,
+			},
+		)
+		if err != nil {
+			return wrapError(errCannotWriteTemplate, err)
+		}
+		return nil
+	}
+	type requiredT struct {
+		Type   string
+		Name   string
+		Colour string
+		Min    int
+		Max    int
+	}
+	_required := make([]requiredT, 0, len(config.Types))
+	for _, courseType := range config.Types {
+		requirement, err := getCourseTypeRequirementForYearGroup(department, courseType.Handle)
+		if err != nil {
+			return err
+		}
+		_required = append(_required, requiredT{
+			Type:   courseType.Handle,
+			Name:   courseType.Name,
+			Colour: courseType.Colour,
+			Min:    requirement.Min,
+			Max:    requirement.Max,
+		})
+	}
+
+	maxChoices, err := getMaxChoicesForYearGroup(department)
+	if err != nil {
+		return err
 	}
 
 	err = tmpl.ExecuteTemplate(
@@ -136,23 +259,25 @@ func handleIndex(w http.ResponseWriter, req *http.Request) (string, int, error)
 		struct {
 			Name       string
 			Department string
-			Groups     *map[string]groupT
-			Required   struct {
-				Sport    int
-				NonSport int
-			}
+			Groups     []templateGroupT
+			Required   []requiredT
+			MaxChoices int
+			Lottery    bool
+			As         string
+			Manager    string
 		}{
-			username,
+			name,
 			department,
-			&_groups,
-			struct {
-				Sport    int
-				NonSport int
-			}{sportRequired, nonSportRequired},
+			groups,
+			_required,
+			maxChoices,
+			config.Mode == selectionModeLottery,
+			as,
+			manager,
 		},
 	)
 	if err != nil {
-		return "", -1, wrapError(errCannotWriteTemplate, err)
+		return wrapError(errCannotWriteTemplate, err)
 	}
-	return "", -1, nil
+	return nil
 }
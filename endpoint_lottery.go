@@ -0,0 +1,89 @@
+/*
+ * Run the lottery allocation
+ *
+ * Copyright (C) 2024  Runxi Yu <https://runxiyu.org>
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"encoding/csv"
+	"net/http"
+	"strconv"
+)
+
+func handleLottery(w http.ResponseWriter, req *http.Request) (string, int, error) {
+	if req.Method != http.MethodPost {
+		return "", http.StatusMethodNotAllowed, errPostOnly
+	}
+
+	userID, _, department, err := getUserInfoFromRequest(req)
+	if err != nil {
+		return "", -1, err
+	}
+	if department != staffDepartment {
+		return "", http.StatusForbidden, errStaffOnly
+	}
+
+	if config.Mode != selectionModeLottery {
+		return "", http.StatusBadRequest, errLotteryModeOnly
+	}
+
+	if getState() == stateOpen {
+		return "", http.StatusBadRequest, errStopCourseSelectionsFirst
+	}
+
+	/* TODO: Potential race. The global state may need to be write-locked. */
+
+	seedString := req.FormValue("seed")
+	seed, err := strconv.ParseUint(seedString, 10, 64)
+	if err != nil {
+		return "", http.StatusBadRequest, wrapError(errInvalidSeed, err)
+	}
+
+	report, err := runLottery(req.Context(), seed, userID)
+	if err != nil {
+		return "", -1, err
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", "attachment;filename=cca_lottery_"+seedString+".csv")
+	csvWriter := csv.NewWriter(w)
+	err = csvWriter.Write([]string{
+		"Student Name",
+		"Student ID",
+		"Grade/Year",
+		"Container",
+		"Preferences",
+		"Allocated",
+		"Rank",
+		"Note",
+	})
+	if err != nil {
+		return "", -1, wrapError(errHTTPWrite, err)
+	}
+	err = csvWriter.WriteAll(report)
+	if err != nil {
+		return "", -1, wrapError(errHTTPWrite, err)
+	}
+	csvWriter.Flush()
+	err = csvWriter.Error()
+	if err != nil {
+		return "", -1, wrapError(errHTTPWrite, err)
+	}
+	return "", -1, nil
+}
@@ -0,0 +1,132 @@
+/*
+ * Manage choices on behalf of students
+ *
+ * Copyright (C) 2024  Runxi Yu <https://runxiyu.org>
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+)
+
+/*
+ * Find the student matching the query, which may be their user ID, email
+ * address or student ID.
+ */
+func findStudent(ctx context.Context, query string) (userID, name, department string, retErr error) {
+	query = strings.ToLower(strings.TrimSpace(query))
+	rows, err := db.Query(
+		ctx,
+		"SELECT id, name, department FROM users WHERE department != ALL($1) AND (id = $2 OR lower(email) = $2 OR lower(split_part(email, '@', 1)) IN ($2, 's' || $2))",
+		nonStudentDepartments,
+		query,
+	)
+	if err != nil {
+		return "", "", "", wrapError(errUnexpectedDBError, err)
+	}
+	defer rows.Close()
+	found := false
+	for rows.Next() {
+		if found {
+			return "", "", "", wrapAny(errAmbiguousStudent, query)
+		}
+		err := rows.Scan(&userID, &name, &department)
+		if err != nil {
+			return "", "", "", wrapError(errUnexpectedDBError, err)
+		}
+		found = true
+	}
+	err = rows.Err()
+	if err != nil {
+		return "", "", "", wrapError(errUnexpectedDBError, err)
+	}
+	if !found {
+		return "", "", "", wrapAny(errNoSuchStudent, query)
+	}
+	return userID, name, department, nil
+}
+
+/*
+ * Get the department of the student with the given user ID, making sure that
+ * they really are a student.
+ */
+func getStudentDepartment(ctx context.Context, userID string) (string, error) {
+	var department string
+	err := db.QueryRow(
+		ctx,
+		"SELECT department FROM users WHERE id = $1 AND department != ALL($2)",
+		userID,
+		nonStudentDepartments,
+	).Scan(&department)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return "", wrapAny(errNoSuchStudent, userID)
+		}
+		return "", wrapError(errUnexpectedDBError, err)
+	}
+	return department, nil
+}
+
+/*
+ * Show the student page for a student, so that staff could choose courses on
+ * their behalf. The WebSocket connection from the page acts as the student,
+ * but everything done through it is recorded as done by the staff member.
+ */
+func handleManage(w http.ResponseWriter, req *http.Request) (string, int, error) {
+	_, username, department, err := getUserInfoFromRequest(req)
+	if err != nil {
+		return "", -1, err
+	}
+	if department != staffDepartment {
+		return "", http.StatusForbidden, errStaffOnly
+	}
+
+	studentID, studentName, studentDepartment, err := findStudent(
+		req.Context(),
+		req.FormValue("student"),
+	)
+	if err != nil {
+		if errors.Is(err, errNoSuchStudent) || errors.Is(err, errAmbiguousStudent) {
+			return "", http.StatusNotFound, err
+		}
+		return "", -1, err
+	}
+
+	groups, err := getTemplateGroups()
+	if err != nil {
+		return "", -1, err
+	}
+
+	err = writeStudentPage(
+		w,
+		studentName,
+		studentDepartment,
+		groups,
+		studentID,
+		username,
+	)
+	if err != nil {
+		return "", -1, err
+	}
+	return "", -1, nil
+}
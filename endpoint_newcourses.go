@@ -1,5 +1,5 @@
 /*
- * Overwrite courses with uploaded CSV
+ * Preview and apply uploaded course lists
  *
  * Copyright (C) 2024  Runxi Yu <https://runxiyu.org>
  * SPDX-License-Identifier: AGPL-3.0-or-later
@@ -21,24 +21,20 @@
 package main
 
 import (
-	"context"
-	"encoding/csv"
-	"errors"
-	"fmt"
-	"io"
 	"net/http"
-	"strings"
 	"sync/atomic"
-
-	"github.com/jackc/pgx/v5"
 )
 
+/*
+ * Parse an uploaded course list and show what importing it would do, without
+ * changing anything. The import is applied with handleApplyNewCourses.
+ */
 func handleNewCourses(w http.ResponseWriter, req *http.Request) (string, int, error) {
 	if req.Method != http.MethodPost {
 		return "", http.StatusMethodNotAllowed, errPostOnly
 	}
 
-	_, _, department, err := getUserInfoFromRequest(req)
+	_, username, department, err := getUserInfoFromRequest(req)
 	if err != nil {
 		return "", -1, err
 	}
@@ -46,177 +42,92 @@ func handleNewCourses(w http.ResponseWriter, req *http.Request) (string, int, er
 		return "", http.StatusForbidden, errStaffOnly
 	}
 
-	if atomic.LoadUint32(&state) != 0 {
-		return "", http.StatusBadRequest, errDisableStudentAccessFirst
+	data, filename, status, err := readUploadedSpreadsheet(w, req, "coursecsv")
+	if err != nil {
+		return "", status, err
 	}
 
-	/* TODO: Potential race. The global state may need to be write-locked. */
+	imp := parseCourseFile(filename, data)
+	var token string
+	if len(imp.Problems) == 0 {
+		token, err = storePendingImport(imp)
+		if err != nil {
+			return "", -1, err
+		}
+	}
 
-	file, fileHeader, err := req.FormFile("coursecsv")
+	err = tmpl.ExecuteTemplate(
+		w,
+		"import",
+		struct {
+			Name     string
+			Import   *courseImportT
+			Diff     importDiffT
+			Token    string
+			Disabled bool
+		}{
+			username,
+			imp,
+			diffCourseImport(imp),
+			token,
+			getState() == stateDisabled,
+		},
+	)
 	if err != nil {
-		return "", http.StatusBadRequest, wrapError(errFormNoFile, err)
+		return "", -1, wrapError(errCannotWriteTemplate, err)
 	}
+	return "", -1, nil
+}
 
-	if fileHeader.Header.Get("Content-Type") != "text/csv" {
-		return "", http.StatusBadRequest, errNotACSV
+/*
+ * Apply a course list that has been previewed, either updating courses in
+ * place or replacing all of them.
+ */
+func handleApplyNewCourses(w http.ResponseWriter, req *http.Request) (string, int, error) {
+	if req.Method != http.MethodPost {
+		return "", http.StatusMethodNotAllowed, errPostOnly
 	}
 
-	csvReader := csv.NewReader(file)
-	titleLine, err := csvReader.Read()
+	userID, _, department, err := getUserInfoFromRequest(req)
 	if err != nil {
-		return "", http.StatusBadRequest, wrapError(errCannotReadCSV, err)
-	}
-	if titleLine == nil {
-		return "", -1, errUnexpectedNilCSVLine
-	}
-	if len(titleLine) != 8 {
-		return "", -1, wrapAny(errBadCSVFormat, "expecting 8 fields on the first line")
+		return "", -1, err
 	}
-	var titleIndex, maxIndex, teacherIndex, locationIndex,
-		typeIndex, groupIndex, sectionIDIndex,
-		courseIDIndex int = -1, -1, -1, -1, -1, -1, -1, -1
-	for i, v := range titleLine {
-		switch v {
-		case "Title":
-			titleIndex = i
-		case "Max":
-			maxIndex = i
-		case "Teacher":
-			teacherIndex = i
-		case "Location":
-			locationIndex = i
-		case "Type":
-			typeIndex = i
-		case "Group":
-			groupIndex = i
-		case "Section ID":
-			sectionIDIndex = i
-		case "Course ID":
-			courseIDIndex = i
-		}
+	if department != staffDepartment {
+		return "", http.StatusForbidden, errStaffOnly
 	}
 
-	if titleIndex == -1 {
-		return "", http.StatusBadRequest, wrapAny(errMissingCSVColumn, "Title")
-	}
-	if maxIndex == -1 {
-		return "", http.StatusBadRequest, wrapAny(errMissingCSVColumn, "Max")
-	}
-	if teacherIndex == -1 {
-		return "", http.StatusBadRequest, wrapAny(errMissingCSVColumn, "Teacher")
-	}
-	if locationIndex == -1 {
-		return "", http.StatusBadRequest, wrapAny(errMissingCSVColumn, "Location")
-	}
-	if typeIndex == -1 {
-		return "", http.StatusBadRequest, wrapAny(errMissingCSVColumn, "Type")
-	}
-	if groupIndex == -1 {
-		return "", http.StatusBadRequest, wrapAny(errMissingCSVColumn, "Group")
-	}
-	if courseIDIndex == -1 {
-		return "", http.StatusBadRequest, wrapAny(errMissingCSVColumn, "Course ID")
-	}
-	if sectionIDIndex == -1 {
-		return "", http.StatusBadRequest, wrapAny(errMissingCSVColumn, "Section ID")
+	if getState() != stateDisabled {
+		return "", http.StatusBadRequest, errDisableStudentAccessFirst
 	}
 
-	lineNumber := 1
-	ok, statusCode, err := func(ctx context.Context) (retBool bool, retStatus int, retErr error) {
-		tx, err := db.Begin(ctx)
-		if err != nil {
-			return false, -1, wrapError(errUnexpectedDBError, err)
-		}
-		defer func() {
-			err := tx.Rollback(ctx)
-			if err != nil && (!errors.Is(err, pgx.ErrTxClosed)) {
-				retBool, retStatus, retErr = false, -1, wrapError(errUnexpectedDBError, err)
-				return
-			}
-		}()
-		_, err = tx.Exec(
-			ctx,
-			"DELETE FROM choices",
-		)
-		if err != nil {
-			return false, -1, wrapError(errUnexpectedDBError, err)
-		}
-		_, err = tx.Exec(
-			ctx,
-			"DELETE FROM courses",
-		)
-		if err != nil {
-			return false, -1, wrapError(errUnexpectedDBError, err)
-		}
+	/* TODO: Potential race. The global state may need to be write-locked. */
 
-		for {
-			lineNumber++
-			line, err := csvReader.Read()
-			if err != nil {
-				if errors.Is(err, io.EOF) {
-					break
-				}
-				return false, -1, wrapError(errCannotReadCSV, err)
-			}
-			if line == nil {
-				return false, -1, wrapError(errCannotReadCSV, errUnexpectedNilCSVLine)
-			}
-			if len(line) != 8 {
-				return false, -1, wrapAny(errInsufficientFields, fmt.Sprintf(
-					"line %d has insufficient items",
-					lineNumber,
-				))
-			}
-			if !checkCourseType(line[typeIndex]) {
-				return false, -1, wrapAny(errInvalidCourseType,
-					fmt.Sprintf(
-						"line %d has invalid course type \"%s\"\nallowed course types: %s",
-						lineNumber,
-						line[typeIndex],
-						strings.Join(getKeysOfMap(courseTypes), ", "),
-					),
-				)
-			}
-			if !checkCourseGroup(line[groupIndex]) {
-				return false, -1, wrapAny(errInvalidCourseGroup,
-					fmt.Sprintf(
-						"line %d has invalid course group \"%s\"\nallowed course groups: %s",
-						lineNumber,
-						line[groupIndex],
-						strings.Join(getKeysOfMap(courseGroups), ", "),
-					),
-				)
-			}
-			_, err = tx.Exec(
-				ctx,
-				"INSERT INTO courses(nmax, title, teacher, location, ctype, cgroup, section_id, course_id) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)",
-				line[maxIndex],
-				line[titleIndex],
-				line[teacherIndex],
-				line[locationIndex],
-				line[typeIndex],
-				line[groupIndex],
-				line[sectionIDIndex],
-				line[courseIDIndex],
-			)
-			if err != nil {
-				return false, -1, wrapError(errUnexpectedDBError, err)
-			}
-		}
-		err = tx.Commit(ctx)
-		if err != nil {
-			return false, -1, wrapError(errUnexpectedDBError, err)
-		}
-		return true, -1, nil
-	}(req.Context())
+	imp, ok := takePendingImport(req.FormValue("token"))
 	if !ok {
-		return "", statusCode, err
+		return "", http.StatusBadRequest, errNoSuchImport
+	}
+
+	err = applyCourseImport(
+		req.Context(),
+		imp,
+		req.FormValue("mode") == "replace",
+		req.FormValue("retire") != "",
+		userID,
+	)
+	if err != nil {
+		return "", -1, err
+	}
+
+	err = setupCourseGroups(req.Context())
+	if err != nil {
+		return "", -1, wrapError(errWhileSetttingUpCourseTablesAgain, err)
 	}
 
 	courses.Range(func(key, _ interface{}) bool {
 		courses.Delete(key)
 		return true
 	})
+	atomic.StoreUint32(&numCourses, 0)
 	err = setupCourses(req.Context())
 	if err != nil {
 		return "", -1, wrapError(errWhileSetttingUpCourseTablesAgain, err)
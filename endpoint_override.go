@@ -0,0 +1,152 @@
+/*
+ * Force courses onto or off students
+ *
+ * Copyright (C) 2024  Runxi Yu <https://runxiyu.org>
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+/*
+ * Add or remove a course for a student, bypassing the course selection state
+ * and, if requested, the course's maximum. A reason is required, and is
+ * recorded in the audit log.
+ */
+func handleOverride(w http.ResponseWriter, req *http.Request) (string, int, error) {
+	if req.Method != http.MethodPost {
+		return "", http.StatusMethodNotAllowed, errPostOnly
+	}
+
+	userID, _, department, err := getUserInfoFromRequest(req)
+	if err != nil {
+		return "", -1, err
+	}
+	if department != staffDepartment {
+		return "", http.StatusForbidden, errStaffOnly
+	}
+
+	studentID, _, studentDepartment, err := findStudent(
+		req.Context(),
+		req.FormValue("student"),
+	)
+	if err != nil {
+		if errors.Is(err, errNoSuchStudent) || errors.Is(err, errAmbiguousStudent) {
+			return "", http.StatusBadRequest, err
+		}
+		return "", -1, err
+	}
+
+	_courseID, err := strconv.ParseInt(req.FormValue("course"), 10, strconv.IntSize)
+	if err != nil {
+		return "", http.StatusBadRequest, wrapError(errNoSuchCourse, err)
+	}
+	courseID := int(_courseID)
+	_course, ok := courses.Load(courseID)
+	if !ok {
+		return "", http.StatusBadRequest, wrapAny(errNoSuchCourse, courseID)
+	}
+	course, ok := _course.(*courseT)
+	if !ok {
+		panic("courses map has non-\"*courseT\" items")
+	}
+	if course == nil {
+		return "", http.StatusBadRequest, wrapAny(errNoSuchCourse, courseID)
+	}
+
+	reason := strings.TrimSpace(req.FormValue("reason"))
+	if reason == "" {
+		return "", http.StatusBadRequest, errMissingReason
+	}
+
+	var add bool
+	switch req.FormValue("action") {
+	case "add":
+		add = true
+	case "remove":
+		add = false
+	default:
+		return "", http.StatusBadRequest, wrapAny(errInvalidOverrideAction, req.FormValue("action"))
+	}
+
+	rejection, err := overrideChoice(
+		req.Context(),
+		studentID,
+		studentDepartment,
+		course,
+		add,
+		req.FormValue("exceed") != "",
+		userID,
+		reason,
+	)
+	if err != nil {
+		return "", -1, err
+	}
+	if rejection != "" {
+		return "", http.StatusBadRequest, wrapAny(errOverrideRejected, rejection)
+	}
+
+	http.Redirect(w, req, "/", http.StatusSeeOther)
+	return "", -1, nil
+}
+
+/*
+ * Force a course onto or off a student, returning the reason if it was
+ * rejected. Accepted overrides are recorded in the audit log together with
+ * the change, and rejected ones here.
+ */
+func overrideChoice(
+	ctx context.Context,
+	studentID string,
+	studentDepartment string,
+	course *courseT,
+	add bool,
+	exceed bool,
+	actor string,
+	reason string,
+) (string, error) {
+	var action, rejection string
+	var err error
+	if add {
+		action = auditForceChoose
+		rejection, err = forceChooseCourse(ctx, studentID, studentDepartment, course, exceed, actor, reason)
+	} else {
+		action = auditForceRemove
+		rejection, err = forceUnchooseCourse(ctx, studentID, course, actor, reason)
+	}
+	if err != nil || rejection == "" {
+		return "", err
+	}
+
+	err = recordRejection(ctx, auditT{
+		UserID:   studentID,
+		Actor:    actor,
+		Action:   action,
+		CourseID: course.ID,
+		Note:     reason,
+	}, rejection) //exhaustruct:ignore
+	if err != nil {
+		return "", err
+	}
+	return rejection, nil
+}
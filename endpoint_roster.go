@@ -0,0 +1,66 @@
+/*
+ * Import the student roster
+ *
+ * Copyright (C) 2024  Runxi Yu <https://runxiyu.org>
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+func handleRoster(w http.ResponseWriter, req *http.Request) (string, int, error) {
+	if req.Method != http.MethodPost {
+		return "", http.StatusMethodNotAllowed, errPostOnly
+	}
+
+	userID, _, department, err := getUserInfoFromRequest(req)
+	if err != nil {
+		return "", -1, err
+	}
+	if department != staffDepartment {
+		return "", http.StatusForbidden, errStaffOnly
+	}
+
+	data, _, status, err := readUploadedSpreadsheet(w, req, "roster")
+	if err != nil {
+		return "", status, err
+	}
+
+	records, err := readSpreadsheet(data)
+	if err != nil {
+		return "", http.StatusBadRequest, err
+	}
+	rows, problems := parseRoster(records)
+	if len(problems) != 0 {
+		return strings.Join(problems, "\n"), http.StatusBadRequest, errInvalidRoster
+	}
+
+	added, updated, err := importRoster(req.Context(), rows, userID)
+	if err != nil {
+		return "", -1, err
+	}
+
+	return fmt.Sprintf(
+		"The roster has been imported. %d students were added and %d were updated.",
+		added,
+		updated,
+	), -1, nil
+}
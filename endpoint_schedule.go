@@ -0,0 +1,102 @@
+/*
+ * Create and cancel scheduled state transitions
+ *
+ * Copyright (C) 2024  Runxi Yu <https://runxiyu.org>
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+/*
+ * This is the format of datetime-local inputs. The time is interpreted in
+ * the server's local time zone.
+ */
+const scheduleTimeLayout = "2006-01-02T15:04"
+
+func handleNewSchedule(w http.ResponseWriter, req *http.Request) (string, int, error) {
+	if req.Method != http.MethodPost {
+		return "", http.StatusMethodNotAllowed, errPostOnly
+	}
+
+	_, _, department, err := getUserInfoFromRequest(req)
+	if err != nil {
+		return "", -1, err
+	}
+	if department != staffDepartment {
+		return "", http.StatusForbidden, errStaffOnly
+	}
+
+	t, err := time.ParseInLocation(scheduleTimeLayout, req.FormValue("time"), time.Local)
+	if err != nil {
+		return "", http.StatusBadRequest, wrapError(errInvalidScheduleTime, err)
+	}
+	if !t.After(time.Now()) {
+		return "", http.StatusBadRequest, wrapAny(errInvalidScheduleTime, "the time is in the past")
+	}
+
+	newState, err := parseState(req.FormValue("state"))
+	if err != nil {
+		return "", http.StatusBadRequest, err
+	}
+
+	err = addSchedule(req.Context(), t, newState)
+	if err != nil {
+		if errors.Is(err, errInvalidState) {
+			return "", http.StatusBadRequest, err
+		}
+		return "", -1, err
+	}
+
+	http.Redirect(w, req, "/", http.StatusSeeOther)
+	return "", -1, nil
+}
+
+func handleCancelSchedule(w http.ResponseWriter, req *http.Request) (string, int, error) {
+	if req.Method != http.MethodPost {
+		return "", http.StatusMethodNotAllowed, errPostOnly
+	}
+
+	_, _, department, err := getUserInfoFromRequest(req)
+	if err != nil {
+		return "", -1, err
+	}
+	if department != staffDepartment {
+		return "", http.StatusForbidden, errStaffOnly
+	}
+
+	id, err := strconv.Atoi(req.PathValue("id"))
+	if err != nil {
+		return "", http.StatusBadRequest, wrapError(errNoSuchSchedule, err)
+	}
+
+	err = cancelSchedule(req.Context(), id)
+	if err != nil {
+		if errors.Is(err, errNoSuchSchedule) {
+			return "", http.StatusNotFound, err
+		}
+		return "", -1, err
+	}
+
+	http.Redirect(w, req, "/", http.StatusSeeOther)
+	return "", -1, nil
+}
@@ -0,0 +1,162 @@
+/*
+ * Logging out and revoking sessions
+ *
+ * Copyright (C) 2024  Runxi Yu <https://runxiyu.org>
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+/*
+ * Find the user matching the query, which may be their user ID or email
+ * address. Unlike findStudent, this matches staff and teachers too.
+ */
+func findUser(ctx context.Context, query string) (userID, name, email string, retErr error) {
+	query = strings.ToLower(strings.TrimSpace(query))
+	rows, err := db.Query(
+		ctx,
+		"SELECT id, name, email FROM users WHERE id = $1 OR lower(email) = $1",
+		query,
+	)
+	if err != nil {
+		return "", "", "", wrapError(errUnexpectedDBError, err)
+	}
+	defer rows.Close()
+	found := false
+	for rows.Next() {
+		if found {
+			return "", "", "", wrapAny(errAmbiguousUser, query)
+		}
+		err := rows.Scan(&userID, &name, &email)
+		if err != nil {
+			return "", "", "", wrapError(errUnexpectedDBError, err)
+		}
+		found = true
+	}
+	err = rows.Err()
+	if err != nil {
+		return "", "", "", wrapError(errUnexpectedDBError, err)
+	}
+	if !found {
+		return "", "", "", wrapAny(errNoSuchUser, query)
+	}
+	return userID, name, email, nil
+}
+
+func handleLogout(w http.ResponseWriter, req *http.Request) (string, int, error) {
+	if req.Method != http.MethodPost {
+		return "", http.StatusMethodNotAllowed, errPostOnly
+	}
+
+	err := endSession(w, req)
+	if err != nil {
+		return "", -1, err
+	}
+
+	http.Redirect(w, req, "/", http.StatusSeeOther)
+	return "", -1, nil
+}
+
+/*
+ * Show the sessions of a user, so that staff could revoke them if a device
+ * is lost or an account is compromised.
+ */
+func handleSessions(w http.ResponseWriter, req *http.Request) (string, int, error) {
+	_, username, department, err := getUserInfoFromRequest(req)
+	if err != nil {
+		return "", -1, err
+	}
+	if department != staffDepartment {
+		return "", http.StatusForbidden, errStaffOnly
+	}
+
+	userID, userName, userEmail, err := findUser(req.Context(), req.FormValue("user"))
+	if err != nil {
+		if errors.Is(err, errNoSuchUser) || errors.Is(err, errAmbiguousUser) {
+			return "", http.StatusNotFound, err
+		}
+		return "", -1, err
+	}
+
+	sessions, err := getUserSessions(req.Context(), userID)
+	if err != nil {
+		return "", -1, err
+	}
+
+	err = tmpl.ExecuteTemplate(
+		w,
+		"sessions",
+		struct {
+			Name      string
+			UserID    string
+			UserName  string
+			UserEmail string
+			Sessions  []sessionT
+		}{
+			username,
+			userID,
+			userName,
+			userEmail,
+			sessions,
+		},
+	)
+	if err != nil {
+		return "", -1, wrapError(errCannotWriteTemplate, err)
+	}
+	return "", -1, nil
+}
+
+/*
+ * Revoke all sessions of a user, which logs them out everywhere and closes
+ * their WebSocket connection.
+ */
+func handleRevokeSessions(w http.ResponseWriter, req *http.Request) (string, int, error) {
+	_ = w
+	if req.Method != http.MethodPost {
+		return "", http.StatusMethodNotAllowed, errPostOnly
+	}
+
+	actor, _, department, err := getUserInfoFromRequest(req)
+	if err != nil {
+		return "", -1, err
+	}
+	if department != staffDepartment {
+		return "", http.StatusForbidden, errStaffOnly
+	}
+
+	userID, userName, _, err := findUser(req.Context(), req.FormValue("user"))
+	if err != nil {
+		if errors.Is(err, errNoSuchUser) || errors.Is(err, errAmbiguousUser) {
+			return "", http.StatusNotFound, err
+		}
+		return "", -1, err
+	}
+
+	count, err := revokeUserSessions(req.Context(), userID, actor)
+	if err != nil {
+		return "", -1, err
+	}
+
+	return "Revoked " + strconv.FormatInt(count, 10) + " sessions of " + userName + ".", -1, nil
+}
@@ -22,11 +22,14 @@ package main
 
 import (
 	"net/http"
-	"strconv"
 )
 
 func handleState(w http.ResponseWriter, req *http.Request) (string, int, error) {
-	_, _, department, err := getUserInfoFromRequest(req)
+	if req.Method != http.MethodPost {
+		return "", http.StatusMethodNotAllowed, errPostOnly
+	}
+
+	userID, _, department, err := getUserInfoFromRequest(req)
 	if err != nil {
 		return "", http.StatusUnauthorized, err
 	}
@@ -34,12 +37,11 @@ func handleState(w http.ResponseWriter, req *http.Request) (string, int, error)
 		return "", http.StatusForbidden, errStaffOnly
 	}
 
-	basePath := req.PathValue("s")
-	newState, err := strconv.ParseUint(basePath, 10, 32)
+	newState, err := parseState(req.PathValue("s"))
 	if err != nil {
-		return "", http.StatusBadRequest, wrapError(errInvalidState, err)
+		return "", http.StatusBadRequest, err
 	}
-	err = setState(req.Context(), uint32(newState))
+	err = setState(req.Context(), newState, userID)
 	if err != nil {
 		return "", http.StatusBadRequest, wrapError(errCannotSetState, err)
 	}
@@ -0,0 +1,103 @@
+/*
+ * Create and revoke API tokens
+ *
+ * Copyright (C) 2024  Runxi Yu <https://runxiyu.org>
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+ * Create an API token. The token is shown in the response, and never again.
+ */
+func handleNewToken(w http.ResponseWriter, req *http.Request) (string, int, error) {
+	_ = w
+	if req.Method != http.MethodPost {
+		return "", http.StatusMethodNotAllowed, errPostOnly
+	}
+
+	userID, _, department, err := getUserInfoFromRequest(req)
+	if err != nil {
+		return "", -1, err
+	}
+	if department != staffDepartment {
+		return "", http.StatusForbidden, errStaffOnly
+	}
+
+	err = req.ParseForm()
+	if err != nil {
+		return "", http.StatusBadRequest, wrapError(errInvalidTokenDetails, err)
+	}
+
+	var expires time.Time
+	if req.FormValue("days") != "" {
+		days, err := strconv.ParseUint(req.FormValue("days"), 10, 16)
+		if err != nil || days == 0 {
+			return "", http.StatusBadRequest, wrapAny(errInvalidTokenDetails, "invalid expiry")
+		}
+		expires = time.Now().AddDate(0, 0, int(days))
+	}
+
+	token, err := createAPIToken(
+		req.Context(),
+		strings.TrimSpace(req.FormValue("name")),
+		req.Form["scope"],
+		expires,
+		userID,
+	)
+	if err != nil {
+		if errors.Is(err, errInvalidTokenDetails) {
+			return "", http.StatusBadRequest, err
+		}
+		return "", -1, err
+	}
+
+	return "Your new API token is shown below. Copy it now, as it will not be shown again. Send it in the \"Authorization: Bearer\" header.\n\n" + token, -1, nil
+}
+
+func handleRevokeToken(w http.ResponseWriter, req *http.Request) (string, int, error) {
+	if req.Method != http.MethodPost {
+		return "", http.StatusMethodNotAllowed, errPostOnly
+	}
+
+	userID, _, department, err := getUserInfoFromRequest(req)
+	if err != nil {
+		return "", -1, err
+	}
+	if department != staffDepartment {
+		return "", http.StatusForbidden, errStaffOnly
+	}
+
+	id, err := strconv.Atoi(req.PathValue("id"))
+	if err != nil {
+		return "", http.StatusNotFound, wrapError(errNoSuchToken, err)
+	}
+	err = revokeAPIToken(req.Context(), id, userID)
+	if err != nil {
+		return "", http.StatusNotFound, err
+	}
+
+	http.Redirect(w, req, "/", http.StatusSeeOther)
+	return "", -1, nil
+}
@@ -65,7 +65,26 @@ func handleWs(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	err = handleConn(req.Context(), c, userID, department)
+	/*
+	 * Staff may act as a student to manage their choices. As connections
+	 * are tracked per user, this replaces the student's own connection if
+	 * they are online.
+	 */
+	actor := userID
+	if as := req.URL.Query().Get("as"); as != "" {
+		if department != staffDepartment {
+			_ = writeText(req.Context(), c, "E :"+errStaffOnly.Error())
+			return
+		}
+		userID = as
+		department, err = getStudentDepartment(req.Context(), as)
+		if err != nil {
+			_ = writeText(req.Context(), c, "E :"+err.Error())
+			return
+		}
+	}
+
+	err = handleConn(req.Context(), c, userID, department, actor)
 	if err != nil {
 		slog.Error(
 			"websocket",
@@ -27,12 +27,16 @@ import (
 
 var (
 	errCannotSetupJwks                  = errors.New("cannot set up jwks")
+	errCannotDiscoverOIDC               = errors.New("cannot fetch openid connect discovery document")
+	errOIDCIssuerMismatch               = errors.New("openid connect discovery document is for a different issuer")
 	errInsufficientFields               = errors.New("insufficient fields")
 	errUnknownDepartment                = errors.New("unknown department")
 	errCannotProcessConfig              = errors.New("cannot process configuration file")
 	errCannotOpenConfig                 = errors.New("cannot open configuration file")
 	errCannotDecodeConfig               = errors.New("cannot decode configuration file")
 	errMissingConfigValue               = errors.New("missing configuration value")
+	errDuplicateConfigValue             = errors.New("duplicate configuration value")
+	errInvalidConfigValue               = errors.New("invalid configuration value")
 	errInvalidCourseType                = errors.New("invalid course type")
 	errInvalidCourseGroup               = errors.New("invalid course group")
 	errMultipleChoicesInOneGroup        = errors.New("multiple choices per group per user")
@@ -51,12 +55,20 @@ var (
 	errCannotCheckCookie                = errors.New("error checking cookie")
 	errNoCookie                         = errors.New("no cookie found")
 	errNoSuchUser                       = errors.New("no such user")
+	errAmbiguousUser                    = errors.New("more than one user matches")
 	errNoSuchYearGroup                  = errors.New("no such year group")
 	errPostOnly                         = errors.New("only post is supported on this endpoint")
+	errMethodNotAllowed                 = errors.New("method not allowed")
 	errMalformedForm                    = errors.New("malformed form")
 	errAuthorizeEndpointError           = errors.New("authorize endpoint returned error")
 	errCannotParseClaims                = errors.New("cannot parse claims")
 	errCannotUnpackClaims               = errors.New("cannot unpack claims")
+	errMissingUserIDClaim               = errors.New("id token does not have the user id claim")
+	errNoPreAuthCookie                  = errors.New("login was not started here or took too long; please try again")
+	errInvalidOIDCState                 = errors.New("state does not match the one this login was started with")
+	errInvalidNonce                     = errors.New("id token nonce does not match the one this login was started with")
+	errInvalidAudience                  = errors.New("id token was not issued for this client")
+	errInvalidIssuer                    = errors.New("id token was not issued by the configured issuer")
 	errJWTMalformed                     = errors.New("jwt token is malformed")
 	errJWTSignatureInvalid              = errors.New("jwt token has invalid signature")
 	errJWTExpired                       = errors.New("jwt token has expired or is not yet valid")
@@ -64,16 +76,39 @@ var (
 	errStaffOnly                        = errors.New("this page is only available to staff")
 	errDisableStudentAccessFirst        = errors.New("you must disable student access before performing this operation")
 	errFormNoFile                       = errors.New("you need to select a file before submitting the form")
-	errNotACSV                          = errors.New("the file you uploaded is not a csv file")
+	errUnsupportedSpreadsheet           = errors.New("the file you uploaded is not a csv, xlsx or ods file")
+	errSpreadsheetTooLarge              = errors.New("the spreadsheet you uploaded is too large")
 	errCannotReadCSV                    = errors.New("cannot read csv")
-	errBadCSVFormat                     = errors.New("bad csv format")
-	errMissingCSVColumn                 = errors.New("missing csv column")
-	errUnexpectedNilCSVLine             = errors.New("unexpected nil csv line")
+	errCannotReadUpload                 = errors.New("cannot read uploaded file")
 	errWhileSetttingUpCourseTablesAgain = errors.New("error while setting up course tables again")
 	errCannotWriteTemplate              = errors.New("cannot write template")
 	errUnknownCommand                   = errors.New("unknown command")
 	errBadNumberOfArguments             = errors.New("bad number of arguments")
 	errInvalidYearGroupOrCourseType     = errors.New("invalid year group or course type (something is broken)")
+	errLotteryModeOnly                  = errors.New("this operation is only available in lottery mode")
+	errStopCourseSelectionsFirst        = errors.New("you must stop course selections before performing this operation")
+	errInvalidSeed                      = errors.New("invalid seed")
+	errDuplicatePreference              = errors.New("duplicate course in preferences")
+	errNoSuchSchedule                   = errors.New("no such schedule")
+	errInvalidScheduleTime              = errors.New("invalid schedule time")
+	errNoSuchStudent                    = errors.New("no such student")
+	errAmbiguousStudent                 = errors.New("more than one student matches")
+	errMissingReason                    = errors.New("you must give a reason")
+	errInvalidOverrideAction            = errors.New("invalid override action")
+	errOverrideRejected                 = errors.New("cannot override")
+	errInvalidCourse                    = errors.New("invalid course")
+	errCourseInUse                      = errors.New("the course has been chosen, waited for or ranked by students")
+	errCannotMarshalJSON                = errors.New("cannot marshal json")
+	errCannotUnmarshalJSON              = errors.New("cannot unmarshal json")
+	errInvalidToken                     = errors.New("invalid api token")
+	errInvalidTokenDetails              = errors.New("invalid details for a new api token")
+	errNoSuchToken                      = errors.New("no such api token")
+	errTokenScope                       = errors.New("the api token does not allow this request")
+	errNoSuchFile                       = errors.New("no such file")
+	errNotYourCourse                    = errors.New("you may only see the students in your own courses")
+	errInvalidRoster                    = errors.New("the roster has problems; nothing was imported")
+	errInvalidFilter                    = errors.New("invalid filter")
+	errNoSuchImport                     = errors.New("the preview has expired or has already been applied; upload the file again")
 	// errInvalidCourseID                  = errors.New("invalid course id")
 )
 
@@ -5,7 +5,9 @@ export default [
 			globals: {
 				document: "readonly",
 				alert: "readonly",
-				WebSocket: "readonly"
+				WebSocket: "readonly",
+				setInterval: "readonly",
+				clearInterval: "readonly"
 			}
 		}
 	},
@@ -21,7 +21,10 @@
  */
 
 document.addEventListener("DOMContentLoaded", () => {
-	const socket = new WebSocket("wss://cca.runxiyu.org/ws");
+	/* Staff managing a student's choices connect as the student */
+	const manage = document.getElementById("manage");
+	const socket = new WebSocket("wss://cca.runxiyu.org/ws" +
+		(manage === null ? "" : `?as=${ encodeURIComponent(manage.dataset.as) }`));
 
 	/*
 	 * TODO I want to make this easily configurable somehow, but I'm unsure
@@ -39,8 +42,158 @@ document.addEventListener("DOMContentLoaded", () => {
 	 *   provides contextual escaping.
 	 */
 
+	/*
+	 * Check whether the number of chosen courses of each type is within
+	 * the range required for the student's year group.
+	 */
+	let requirementsMet = () => {
+		let met = true;
+		document.querySelectorAll(".type-chosen").forEach(c => {
+			let chosen = parseInt(c.textContent);
+			let max = parseInt(c.dataset.max);
+			if (chosen < parseInt(c.dataset.min) || (max >= 0 && chosen > max)) {
+				met = false;
+			}
+		});
+		let total = document.getElementById("total-chosen");
+		if (total !== null && parseInt(total.textContent) > parseInt(total.dataset.max)) {
+			met = false;
+		}
+		return met;
+	};
+
+	/*
+	 * Update the number of chosen courses of the given course's type, and
+	 * the total number of chosen courses if it is displayed.
+	 */
+	let addChosen = (courseID, delta) => {
+		let courseType = document.getElementById(`tick${ courseID }`).dataset.type;
+		let chosen = document.getElementById(`${ courseType }-chosen`);
+		chosen.textContent = parseInt(chosen.textContent) + delta;
+		let total = document.getElementById("total-chosen");
+		if (total !== null) {
+			total.textContent = parseInt(total.textContent) + delta;
+		}
+	};
+
+	let gstate = "disabled";
+
+	const stateDescriptions = {
+		"disabled": "disabled",
+		"read-only": "closed",
+		"open": "open",
+		"confirm-only": "closed, but you may still confirm or unconfirm your choices",
+		"results-published": "closed, and the results have been published"
+	};
+
+	/*
+	 * Courses are ranked instead of chosen directly in lottery mode, and
+	 * there is nothing to confirm until they are allocated
+	 */
+	const lottery = document.querySelector(".rankselect") !== null;
+
+	let canConfirm = () => !lottery && (gstate === "open" || gstate === "confirm-only");
+
+	/*
+	 * The waitlist button is shown for full courses that the student is
+	 * eligible for but has not chosen, and for courses whose waitlist the
+	 * student is already on so they could leave it.
+	 */
+	let updateWaitButton = courseID => {
+		let button = document.getElementById(`wait${ courseID }`);
+		if (button === null) {
+			return;
+		}
+		let tick = document.getElementById(`tick${ courseID }`);
+		let full = document.getElementById(`selected${ courseID }`).textContent ===
+			document.getElementById(`max${ courseID }`).textContent;
+		if (button.dataset.waiting === "true") {
+			button.textContent = "Leave waitlist";
+			button.hidden = false;
+		} else {
+			button.textContent = "Join waitlist";
+			button.hidden = !(gstate === "open" && full && !tick.checked &&
+				tick.dataset.ineligible === undefined);
+		}
+		button.disabled = gstate !== "open";
+	};
+
+	let setWaiting = (courseID, waiting) => {
+		document.getElementById(`wait${ courseID }`).dataset.waiting = waiting;
+		updateWaitButton(courseID);
+	};
+
+	/*
+	 * Show the student's ranking of the courses in the group, with the
+	 * course IDs ordered from the most preferred.
+	 */
+	let setRanks = (group, courseIDs) => {
+		document.querySelectorAll(".rankselect").forEach(c => {
+			if (c.dataset.group === group) {
+				let rank = courseIDs.indexOf(c.dataset.course);
+				c.value = rank === -1 ? "" : `${ rank + 1 }`;
+			}
+		});
+	};
+
+	/*
+	 * Show the number of students who chose the course, and enable or
+	 * disable its checkbox depending on whether it is full.
+	 */
+	let updateSelected = (courseID, selected) => {
+		document.getElementById(`selected${ courseID }`).
+			textContent = selected;
+		if (
+			selected === document.getElementById(`max${ courseID }`).textContent &&
+			!(document.getElementById(`tick${ courseID }`).checked)
+		) {
+			document.getElementById(`tick${ courseID }`).disabled = true;
+		} else if (gstate === "open" && !lottery &&
+			(document.getElementById(`tick${ courseID }`).dataset.ineligible === undefined ||
+			document.getElementById(`tick${ courseID }`).checked)) {
+			document.getElementById(`tick${ courseID }`).disabled = false;
+		}
+		updateWaitButton(courseID);
+	};
+
+	let countdownInterval = null;
+
+	/*
+	 * Count down to the next scheduled change of the course selection
+	 * state, given as the state and a UNIX timestamp in seconds. This
+	 * relies on the student's clock being reasonably accurate.
+	 */
+	let startCountdown = (newState, time) => {
+		let countdown = document.getElementById("countdown");
+		if (countdownInterval !== null) {
+			clearInterval(countdownInterval);
+			countdownInterval = null;
+		}
+		if (newState === undefined) {
+			countdown.hidden = true;
+			return;
+		}
+		let change = {
+			"disabled": "Student access will be disabled",
+			"read-only": "Course selections will close",
+			"open": "Course selections will open",
+			"confirm-only": "Course selections will close, except for confirming choices,",
+			"results-published": "The results will be published"
+		}[newState];
+		let target = parseInt(time) * 1000;
+		let update = () => {
+			let seconds = Math.max(0, Math.floor((target - Date.now()) / 1000));
+			let h = Math.floor(seconds / 3600);
+			let m = `${ Math.floor(seconds / 60) % 60 }`.padStart(2, "0");
+			let s = `${ seconds % 60 }`.padStart(2, "0");
+			countdown.textContent = `${ change } in ${ h }:${ m }:${ s }.`;
+		};
+		update();
+		countdownInterval = setInterval(update, 1000);
+		countdown.hidden = false;
+	};
+
 	socket.addEventListener("open", function() {
-		let gstate = 0;
 		let ustate = 0;
 		let _handleMessage = event => {
 			let msg = new String(event?.data);
@@ -84,28 +237,19 @@ document.addEventListener("DOMContentLoaded", () => {
 						document.getElementById(
 							`tick${ courseIDs[i] }`
 						).checked = true;
-						{
-							let courseType = document.
-								getElementById(`type${ courseIDs[i] }`).
-								textContent;
-							document.getElementById(`${ courseType }-chosen`).
-								textContent = parseInt(document.
-									getElementById(`${ courseType }-chosen`).
-									textContent) + 1;
-						}
-						if (gstate === 1) {
+						addChosen(courseIDs[i], 1);
+						if (gstate === "open" && !lottery) {
 							document.getElementById(
 								`tick${ courseIDs[i] }`
 							).disabled = false;
-							if (parseInt(document.getElementById("Sport-chosen").textContent) >=
-								parseInt(document.getElementById("Sport-required").textContent) &&
-								parseInt(document.getElementById("Non-sport-chosen").textContent) >=
-								parseInt(document.getElementById("Non-sport-required").textContent)) {
-								document.getElementById("confirmbutton").disabled = false;
-							}
 						}
 					}
 				}
+				document.getElementById("confirmbutton").disabled =
+					!(requirementsMet() && canConfirm());
+				document.querySelectorAll(".waitbutton").forEach(c => {
+					updateWaitButton(c.dataset.course);
+				});
 				if (ustate === 1) {
 					document.querySelectorAll(".confirmed-handle").forEach(c => {
 						let handle = c.textContent;
@@ -118,7 +262,7 @@ document.addEventListener("DOMContentLoaded", () => {
 								document.getElementById(`confirmed-name-${ handle }`).textContent =
 									d.dataset.title;
 								document.getElementById(`confirmed-type-${ handle }`).textContent =
-									d.dataset.type;
+									d.dataset.typename;
 								document.getElementById(`confirmed-teacher-${ handle }`).textContent =
 									d.dataset.teacher;
 								document.getElementById(`confirmed-location-${ handle }`).textContent =
@@ -139,6 +283,35 @@ document.addEventListener("DOMContentLoaded", () => {
 					});
 				}
 				break;
+			case "P": /* preferences in a course group */
+				setRanks(mar[1], mar[2] === "" ? [] : mar[2].split(","));
+				break;
+			case "RP": /* preferences rejected */
+				alert(mar[2]);
+				break;
+			case "T": /* next scheduled state change */
+				startCountdown(mar[1], mar[2]);
+				break;
+			case "HW": /* waitlists the student is on */
+				if (mar[1] !== "") {
+					mar[1].split(",").forEach(courseID => {
+						setWaiting(courseID, true);
+					});
+				}
+				break;
+			case "W": /* joined waitlist */
+				setWaiting(mar[1], true);
+				break;
+			case "NW": /* left waitlist */
+				setWaiting(mar[1], false);
+				break;
+			case "RW": /* waitlist rejected, or removed from waitlist */
+				document.getElementById(`coursestatus${ mar[1] }`).
+					textContent = mar[2];
+				document.getElementById(`coursestatus${ mar[1] }`).
+					style.color = "red";
+				setWaiting(mar[1], false);
+				break;
 			case "U": /* unauthenticated */
 				/* TODO: replace this with a box on screen */
 				alert("Your session is broken or has expired. You are unauthenticated and the server will reject your commands.");
@@ -148,33 +321,38 @@ document.addEventListener("DOMContentLoaded", () => {
 					checked = false;
 				document.getElementById(`tick${ mar[1] }`).
 					indeterminate = false;
-				{
-					let courseType = document.getElementById(`type${ mar[1] }`).
-						textContent;
-					document.getElementById(`${ courseType }-chosen`).textContent =
-						parseInt(document.
-							getElementById(`${ courseType }-chosen`).
-							textContent) - 1;
-				}
-				if (parseInt(document.getElementById("Sport-chosen").textContent) <
-					parseInt(document.getElementById("Sport-required").textContent) ||
-					parseInt(document.getElementById("Non-sport-chosen").textContent) <
-					parseInt(document.getElementById("Non-sport-required").textContent)) {
-					document.getElementById("confirmbutton").disabled = true;
-				}
+				addChosen(mar[1], -1);
+				document.getElementById("confirmbutton").disabled =
+					!(requirementsMet() && canConfirm());
+				updateWaitButton(mar[1]);
 				break;
 			case "M":
-				document.getElementById(`selected${ mar[1] }`).
-					textContent = mar[2];
-				if (
-					mar[2] === document.getElementById(`max${ mar[1] }`).textContent &&
-					!(document.getElementById(`tick${ mar[1] }`).checked)
-				) {
-					document.getElementById(`tick${ mar[1] }`).disabled = true;
-				} else if (gstate === 1) {
-					document.getElementById(`tick${ mar[1] }`).disabled = false;
+				updateSelected(mar[1], mar[2]);
+				break;
+			case "C": /* course details changed */
+				{
+					let course = JSON.parse(mar[2]);
+					let tick = document.getElementById(`tick${ mar[1] }`);
+					if (tick === null) {
+						/* Added after the page was loaded */
+						break;
+					}
+					tick.dataset.title = course.title;
+					tick.dataset.teacher = course.teacher;
+					tick.dataset.location = course.location;
+					document.getElementById(`title${ mar[1] }`).textContent = course.title;
+					document.getElementById(`teacher${ mar[1] }`).textContent = course.teacher;
+					document.getElementById(`location${ mar[1] }`).textContent = course.location;
+					document.getElementById(`max${ mar[1] }`).textContent = `${ course.max }`;
+					updateSelected(mar[1], `${ course.selected }`);
 				}
 				break;
+			case "CR": /* course retired */
+				document.getElementById(`course${ mar[1] }`)?.remove();
+				break;
+			case "CL": /* course list changed */
+				document.getElementById("courses-changed").hidden = false;
+				break;
 			case "R": /* course selection rejected */
 				document.getElementById(`coursestatus${ mar[1] }`).
 					textContent = mar[2];
@@ -188,6 +366,17 @@ document.addEventListener("DOMContentLoaded", () => {
 					document.getElementById(`tick${ mar[1] }`).
 						disabled = true;
 				}
+				updateWaitButton(mar[1]);
+				break;
+			case "RN": /* course unselection rejected */
+				document.getElementById(`coursestatus${ mar[1] }`).
+					textContent = mar[2];
+				document.getElementById(`coursestatus${ mar[1] }`).
+					style.color = "red";
+				document.getElementById(`tick${ mar[1] }`).
+					checked = true;
+				document.getElementById(`tick${ mar[1] }`).
+					indeterminate = false;
 				break;
 			case "Y": /* course selection approved */
 				document.getElementById(`coursestatus${ mar[1] }`).
@@ -198,48 +387,32 @@ document.addEventListener("DOMContentLoaded", () => {
 					checked = true;
 				document.getElementById(`tick${ mar[1] }`).
 					indeterminate = false;
-				{
-					let courseType = document.getElementById(`type${ mar[1] }`).
-						textContent;
-					document.getElementById(`${ courseType }-chosen`).textContent =
-						parseInt(document.
-							getElementById(`${ courseType }-chosen`).
-							textContent) + 1;
-				}
-				if (parseInt(document.getElementById("Sport-chosen").textContent) >=
-					parseInt(document.getElementById("Sport-required").textContent) &&
-					parseInt(document.getElementById("Non-sport-chosen").textContent) >=
-					parseInt(document.getElementById("Non-sport-required").textContent) &&
-					gstate === 1) {
-					document.getElementById("confirmbutton").disabled = false;
-				}
+				addChosen(mar[1], 1);
+				document.getElementById("confirmbutton").disabled =
+					!(requirementsMet() && canConfirm());
+				/* Choosing a course, including by promotion, leaves its waitlist */
+				setWaiting(mar[1], false);
 				break;
-			case "STOP":
-				gstate = 0;
-				document.getElementById("stateindicator").textContent = "disabled";
-				document.getElementById("confirmbutton").disabled = true;
-				document.getElementById("unconfirmbutton").disabled = true;
-				document.querySelectorAll(".coursecheckbox").forEach(c => {
-					c.disabled = true;
+			case "S": /* course selection state */
+				gstate = mar[1];
+				document.getElementById("stateindicator").textContent =
+					stateDescriptions[gstate];
+				document.getElementById("confirmbutton").disabled =
+					!(requirementsMet() && canConfirm());
+				document.getElementById("unconfirmbutton").disabled = !canConfirm();
+				document.querySelectorAll(".rankselect").forEach(c => {
+					c.disabled = gstate !== "open" || c.dataset.ineligible !== undefined;
 				});
-				break;
-			case "START":
-				gstate = 1;
-				document.getElementById("unconfirmbutton").disabled = false;
 				document.querySelectorAll(".courseitem").forEach(c => {
-					if (c.querySelector(".selected-number").textContent !==
-						c.querySelector(".max-number").textContent ||
-						c.querySelector(".coursecheckbox").checked) {
-						c.querySelector(".coursecheckbox").disabled = false;
-					}
+					let tick = c.querySelector(".coursecheckbox");
+					tick.disabled = !(gstate === "open" && !lottery && (tick.checked ||
+						(c.querySelector(".selected-number").textContent !==
+						c.querySelector(".max-number").textContent &&
+						tick.dataset.ineligible === undefined)));
+				});
+				document.querySelectorAll(".waitbutton").forEach(c => {
+					updateWaitButton(c.dataset.course);
 				});
-				if (parseInt(document.getElementById("Sport-chosen").textContent) >=
-					parseInt(document.getElementById("Sport-required").textContent) &&
-					parseInt(document.getElementById("Non-sport-chosen").textContent) >=
-					parseInt(document.getElementById("Non-sport-required").textContent)) {
-					document.getElementById("confirmbutton").disabled = false;
-				}
-				document.getElementById("stateindicator").textContent = "enabled";
 				break;
 			case "YC":
 				ustate = 1;
@@ -254,7 +427,7 @@ document.addEventListener("DOMContentLoaded", () => {
 							document.getElementById(`confirmed-name-${ handle }`).textContent =
 								d.dataset.title;
 							document.getElementById(`confirmed-type-${ handle }`).textContent =
-								d.dataset.type;
+								d.dataset.typename;
 							document.getElementById(`confirmed-teacher-${ handle }`).textContent =
 								d.dataset.teacher;
 							document.getElementById(`confirmed-location-${ handle }`).textContent =
@@ -276,6 +449,9 @@ document.addEventListener("DOMContentLoaded", () => {
 				break;
 			case "NC":
 				ustate = 0;
+				if (mar.length > 1) {
+					alert(mar[1]);
+				}
 				document.querySelectorAll(".unconfirmed").forEach(c => {
 					c.style.display = "block";
 				});
@@ -337,6 +513,50 @@ document.addEventListener("DOMContentLoaded", () => {
 		});
 	});
 
+	document.querySelectorAll(".rankselect").forEach(c => {
+		let count = 0;
+		document.querySelectorAll(".rankselect").forEach(d => {
+			if (d.dataset.group === c.dataset.group) {
+				count++;
+			}
+		});
+		for (let i = 1; i <= count; i++) {
+			let option = document.createElement("option");
+			option.value = `${ i }`;
+			option.textContent = `${ i }`;
+			c.appendChild(option);
+		}
+
+		c.addEventListener("change", () => {
+			/*
+			 * Move the course to the chosen rank, keeping the order of
+			 * the other ranked courses in the group.
+			 */
+			let ranked = [];
+			document.querySelectorAll(".rankselect").forEach(d => {
+				if (d.dataset.group === c.dataset.group && d !== c && d.value !== "") {
+					ranked.push(d);
+				}
+			});
+			ranked.sort((a, b) => parseInt(a.value) - parseInt(b.value));
+			let courseIDs = ranked.map(d => d.dataset.course);
+			if (c.value !== "") {
+				courseIDs.splice(parseInt(c.value) - 1, 0, c.dataset.course);
+			}
+			socket.send(`P ${ c.dataset.group } :${ courseIDs.join(",") }`);
+		});
+	});
+
+	document.querySelectorAll(".waitbutton").forEach(c => {
+		c.addEventListener("click", () => {
+			if (c.dataset.waiting === "true") {
+				socket.send(`NW ${ c.dataset.course }`);
+			} else {
+				socket.send(`W ${ c.dataset.course }`);
+			}
+		});
+	});
+
 	document.getElementById("confirmbutton").addEventListener("click", () => {
 		socket.send("YC");
 	});
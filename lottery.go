@@ -0,0 +1,456 @@
+/*
+ * Lottery allocation of courses by ranked preferences
+ *
+ * Copyright (C) 2024  Runxi Yu <https://runxiyu.org>
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	selectionModeFCFS    = "fcfs"
+	selectionModeLottery = "lottery"
+)
+
+type lotteryStudentT struct {
+	ID          string
+	Name        string
+	Email       string
+	StudentID   string
+	Department  string
+	Preferences map[string][]*courseT /* course group handle to courses, most preferred first */
+	Chosen      map[string]*courseT   /* course group handle to course */
+	Types       userCourseTypesT
+}
+
+/*
+ * Check whether the student could still reach the minimums of their year
+ * group, after choosing the given course. This only considers the number of
+ * remaining course groups and the total number of courses allowed, not
+ * whether there are still seats in suitable courses.
+ */
+func (student *lotteryStudentT) minimumsReachableWith(course *courseT, numGroups int) (bool, error) {
+	needed := 0
+	for _, courseType := range getCourseTypeHandles() {
+		requirement, err := getCourseTypeRequirementForYearGroup(student.Department, courseType)
+		if err != nil {
+			return false, wrapError(errInvalidYearGroupOrCourseType, err)
+		}
+		chosen := student.Types[courseType]
+		if courseType == course.Info().Type {
+			chosen++
+		}
+		if chosen < requirement.Min {
+			needed += requirement.Min - chosen
+		}
+	}
+
+	if needed > numGroups-len(student.Chosen)-1 {
+		return false, nil
+	}
+
+	maxChoices, err := getMaxChoicesForYearGroup(student.Department)
+	if err != nil {
+		return false, wrapError(errInvalidYearGroupOrCourseType, err)
+	}
+	if maxChoices >= 0 && needed > maxChoices-student.Types.total()-1 {
+		return false, nil
+	}
+	return true, nil
+}
+
+/*
+ * Find the course the student prefers the most among those that they may
+ * still be allocated. Preferences of the same rank in different course
+ * groups are considered in the order of the course groups.
+ */
+func (student *lotteryStudentT) bestAvailable(
+	remaining map[int]uint32,
+	groupHandles []string,
+) (*courseT, error) {
+	maxRank := 0
+	for _, preferences := range student.Preferences {
+		if len(preferences) > maxRank {
+			maxRank = len(preferences)
+		}
+	}
+
+	maxChoices, err := getMaxChoicesForYearGroup(student.Department)
+	if err != nil {
+		return nil, wrapError(errInvalidYearGroupOrCourseType, err)
+	}
+	if maxChoices >= 0 && student.Types.total() >= maxChoices {
+		return nil, nil
+	}
+
+	for rank := 0; rank < maxRank; rank++ {
+		for _, group := range groupHandles {
+			if _, ok := student.Chosen[group]; ok {
+				continue
+			}
+			preferences := student.Preferences[group]
+			if rank >= len(preferences) {
+				continue
+			}
+			course := preferences[rank]
+			info := course.Info()
+			if remaining[course.ID] == 0 || !info.EligibleFor(student.Department) {
+				continue
+			}
+			requirement, err := getCourseTypeRequirementForYearGroup(student.Department, info.Type)
+			if err != nil {
+				return nil, wrapError(errInvalidYearGroupOrCourseType, err)
+			}
+			if requirement.Max >= 0 && student.Types[info.Type] >= requirement.Max {
+				continue
+			}
+			ok, err := student.minimumsReachableWith(course, len(groupHandles))
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				continue
+			}
+			return course, nil
+		}
+	}
+	return nil, nil
+}
+
+/*
+ * Allocate courses to students according to their preferences, with random
+ * serial dictatorship: students are put into a random order determined by the
+ * seed, and in each round, each student in that order is allocated the most
+ * preferred course that they may still take, until no more courses could be
+ * allocated. Existing choices are kept. This must not be run while students
+ * could choose courses.
+ * A report of unmet preferences is returned, in the form of spreadsheet rows.
+ */
+func runLottery(ctx context.Context, seed uint64, actor string) (report [][]string, retErr error) {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return nil, wrapError(errUnexpectedDBError, err)
+	}
+	defer func() {
+		err := tx.Rollback(ctx)
+		if err != nil && (!errors.Is(err, pgx.ErrTxClosed)) {
+			retErr = wrapError(errUnexpectedDBError, err)
+			return
+		}
+	}()
+
+	rows, err := tx.Query(
+		ctx,
+		"SELECT id, name, email, COALESCE(student_id, ''), department FROM users WHERE department != ALL($1) ORDER BY id",
+		nonStudentDepartments,
+	)
+	if err != nil {
+		return nil, wrapError(errUnexpectedDBError, err)
+	}
+	defer rows.Close()
+	students := make([]*lotteryStudentT, 0)
+	studentMap := make(map[string]*lotteryStudentT)
+	for rows.Next() {
+		student := &lotteryStudentT{
+			Preferences: make(map[string][]*courseT),
+			Chosen:      make(map[string]*courseT),
+			Types:       make(userCourseTypesT),
+		} //exhaustruct:ignore
+		err := rows.Scan(&student.ID, &student.Name, &student.Email, &student.StudentID, &student.Department)
+		if err != nil {
+			return nil, wrapError(errUnexpectedDBError, err)
+		}
+		student.StudentID = studentIDOf(student.StudentID, student.Email)
+		if _, ok := config.Req[student.Department]; !ok {
+			continue
+		}
+		students = append(students, student)
+		studentMap[student.ID] = student
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, wrapError(errUnexpectedDBError, err)
+	}
+
+	loadCourse := func(courseID int) (*courseT, error) {
+		_course, ok := courses.Load(courseID)
+		if !ok {
+			return nil, wrapAny(errNoSuchCourse, courseID)
+		}
+		course, ok := _course.(*courseT)
+		if !ok {
+			panic("courses map has non-\"*courseT\" items")
+		}
+		if course == nil {
+			return nil, wrapAny(errNoSuchCourse, courseID)
+		}
+		return course, nil
+	}
+
+	rows, err = tx.Query(ctx, "SELECT userid, courseid FROM choices")
+	if err != nil {
+		return nil, wrapError(errUnexpectedDBError, err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var userID string
+		var courseID int
+		err := rows.Scan(&userID, &courseID)
+		if err != nil {
+			return nil, wrapError(errUnexpectedDBError, err)
+		}
+		student, ok := studentMap[userID]
+		if !ok {
+			continue
+		}
+		course, err := loadCourse(courseID)
+		if err != nil {
+			return nil, err
+		}
+		student.Chosen[course.Info().Group] = course
+		student.Types[course.Info().Type]++
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, wrapError(errUnexpectedDBError, err)
+	}
+
+	rows, err = tx.Query(ctx, "SELECT userid, courseid FROM preferences ORDER BY userid, rank")
+	if err != nil {
+		return nil, wrapError(errUnexpectedDBError, err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var userID string
+		var courseID int
+		err := rows.Scan(&userID, &courseID)
+		if err != nil {
+			return nil, wrapError(errUnexpectedDBError, err)
+		}
+		student, ok := studentMap[userID]
+		if !ok {
+			continue
+		}
+		course, err := loadCourse(courseID)
+		if err != nil {
+			return nil, err
+		}
+		group := course.Info().Group
+		student.Preferences[group] = append(student.Preferences[group], course)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, wrapError(errUnexpectedDBError, err)
+	}
+
+	remaining := make(map[int]uint32)
+	courses.Range(func(key, value interface{}) bool {
+		courseID, ok := key.(int)
+		if !ok {
+			panic("courses map has non-\"int\" keys")
+		}
+		course, ok := value.(*courseT)
+		if !ok {
+			panic("courses map has non-\"*courseT\" items")
+		}
+		selected := atomic.LoadUint32(&course.Selected)
+		nmax := atomic.LoadUint32(&course.Max)
+		if selected < nmax {
+			remaining[courseID] = nmax - selected
+		}
+		return true
+	})
+
+	/*
+	 * Students are sorted by their IDs above, so the order only depends
+	 * on the seed.
+	 */
+	order := make([]*lotteryStudentT, len(students))
+	copy(order, students)
+	rng := rand.New(rand.NewPCG(seed, 0))
+	rng.Shuffle(len(order), func(i, j int) {
+		order[i], order[j] = order[j], order[i]
+	})
+
+	type allocationT struct {
+		Student *lotteryStudentT
+		Course  *courseT
+	}
+	allocations := make([]allocationT, 0)
+	unconfirmed := make([]string, 0)
+	groupHandles := getCourseGroupHandles()
+	seltime := time.Now().UnixMicro()
+	for {
+		allocated := false
+		for _, student := range order {
+			course, err := student.bestAvailable(remaining, groupHandles)
+			if err != nil {
+				return nil, err
+			}
+			if course == nil {
+				continue
+			}
+			wasConfirmed, err := unconfirmForChange(ctx, tx, student.ID, actor, "lottery")
+			if err != nil {
+				return nil, err
+			}
+			if wasConfirmed {
+				unconfirmed = append(unconfirmed, student.ID)
+			}
+			_, err = tx.Exec(
+				ctx,
+				"INSERT INTO choices (seltime, userid, courseid) VALUES ($1, $2, $3)",
+				seltime,
+				student.ID,
+				course.ID,
+			)
+			if err != nil {
+				return nil, wrapError(errUnexpectedDBError, err)
+			}
+			err = recordAudit(ctx, tx, auditT{
+				UserID:   student.ID,
+				Actor:    actor,
+				Action:   auditLottery,
+				CourseID: course.ID,
+				Outcome:  auditAccepted,
+				Note:     "seed " + strconv.FormatUint(seed, 10),
+			}) //exhaustruct:ignore
+			if err != nil {
+				return nil, err
+			}
+			remaining[course.ID]--
+			student.Chosen[course.Info().Group] = course
+			student.Types[course.Info().Type]++
+			allocations = append(allocations, allocationT{student, course})
+			allocated = true
+		}
+		if !allocated {
+			break
+		}
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return nil, wrapError(errUnexpectedDBError, err)
+	}
+
+	changedCourses := make(map[int]*courseT)
+	for _, allocation := range allocations {
+		func() {
+			allocation.Course.SelectedLock.Lock()
+			defer allocation.Course.SelectedLock.Unlock()
+			atomic.AddUint32(&allocation.Course.Selected, 1)
+		}()
+		changedCourses[allocation.Course.ID] = allocation.Course
+		sendToUser(allocation.Student.ID, fmt.Sprintf("Y %d", allocation.Course.ID))
+	}
+	for _, course := range changedCourses {
+		propagateSelectedUpdate(course)
+	}
+	for _, userID := range unconfirmed {
+		notifyUnconfirmed(userID)
+	}
+
+	slog.Info(
+		"lottery",
+		"seed", seed,
+		"students", len(students),
+		"allocations", len(allocations),
+	)
+
+	report = make([][]string, 0)
+	for _, student := range students {
+		for _, group := range groupHandles {
+			preferences := student.Preferences[group]
+			if len(preferences) == 0 {
+				continue
+			}
+			titles := make([]string, 0, len(preferences))
+			for _, course := range preferences {
+				titles = append(titles, course.Info().Title)
+			}
+			var allocatedTitle, rankString, note string
+			chosen, ok := student.Chosen[group]
+			if ok {
+				allocatedTitle = chosen.Info().Title
+				for i, course := range preferences {
+					if course == chosen {
+						rankString = strconv.Itoa(i + 1)
+						break
+					}
+				}
+			}
+			switch {
+			case !ok:
+				note = "No course allocated"
+			case rankString == "":
+				note = "Allocated course not among preferences"
+			case rankString != "1":
+				note = "Not first preference"
+			default:
+				continue
+			}
+			report = append(report, []string{
+				student.Name,
+				student.StudentID,
+				student.Department,
+				group,
+				strings.Join(titles, "; "),
+				allocatedTitle,
+				rankString,
+				note,
+			})
+		}
+		for _, courseType := range getCourseTypeHandles() {
+			requirement, err := getCourseTypeRequirementForYearGroup(student.Department, courseType)
+			if err != nil {
+				return nil, wrapError(errInvalidYearGroupOrCourseType, err)
+			}
+			if student.Types[courseType] < requirement.Min {
+				report = append(report, []string{
+					student.Name,
+					student.StudentID,
+					student.Department,
+					"",
+					"",
+					"",
+					"",
+					fmt.Sprintf(
+						"Only %d of required %d of type %s",
+						student.Types[courseType],
+						requirement.Min,
+						courseType,
+					),
+				})
+			}
+		}
+	}
+	return report, nil
+}
@@ -117,13 +117,51 @@ func main() {
 	)
 
 	slog.Info("registering handlers")
+	/*
+	 * The scopes of API tokens that may use each handler, for GET
+	 * requests and for the others. Handlers without them are not
+	 * available to tokens.
+	 */
+	readExports := []string{scopeReadExports}
+	manageCourses := []string{scopeManageCourses}
+	manageState := []string{scopeManageState}
+
 	http.HandleFunc("/ws", handleWs)
 	setHandler("/{$}", handleIndex)
-	setHandler("/export/choices", handleExportChoices)
-	setHandler("/export/students", handleExportStudents)
+	setHandler("/export/choices", allowTokens(readExports, nil, handleExportChoices))
+	setHandler("/export/students", allowTokens(readExports, nil, handleExportStudents))
+	setHandler("/export/waitlist", allowTokens(readExports, nil, handleExportWaitlist))
+	setHandler("/export/audit", allowTokens(readExports, nil, handleExportAudit))
+	setHandler("/audit", allowTokens(readExports, nil, handleAudit))
+	setHandler("/manage", handleManage)
+	setHandler("/override", handleOverride)
+	setHandler("/roster", handleRoster)
 	setHandler("/auth", handleAuth)
-	setHandler("/state/{s}", handleState)
-	setHandler("/newcourses", handleNewCourses)
+	setHandler("/logout", handleLogout)
+	setHandler("/sessions", handleSessions)
+	setHandler("/sessions/revoke", handleRevokeSessions)
+	setHandler("/state/{s}", allowTokens(manageState, manageState, handleState))
+	setHandler("/newcourses", allowTokens(manageCourses, manageCourses, handleNewCourses))
+	setHandler("/newcourses/apply", allowTokens(manageCourses, manageCourses, handleApplyNewCourses))
+	setHandler("/courses", allowTokens(manageCourses, manageCourses, handleCourses))
+	setHandler("/courses/new", allowTokens(manageCourses, manageCourses, handleNewCourseForm))
+	setHandler("/courses/{id}", allowTokens(manageCourses, manageCourses, handleCourse))
+	setHandler("/courses/{id}/retire", allowTokens(manageCourses, manageCourses, handleRetireCourse))
+	setHandler("/courses/{id}/students", allowTokens(readExports, nil, handleCourseStudents))
+	setHandler("/lottery", handleLottery)
+	setHandler("/schedules", allowTokens(manageState, manageState, handleNewSchedule))
+	setHandler("/schedules/{id}/cancel", allowTokens(manageState, manageState, handleCancelSchedule))
+	setHandler("/tokens", handleNewToken)
+	setHandler("/tokens/{id}/revoke", handleRevokeToken)
+	setHandler("/api/v1/openapi.json", handleAPIOpenAPI)
+	setHandler("/api/v1/courses", allowTokens(apiTokenScopes, manageCourses, handleAPICourses))
+	setHandler("/api/v1/courses/{id}", allowTokens(apiTokenScopes, manageCourses, handleAPICourse))
+	setHandler("/api/v1/courses/{id}/students", allowTokens(readExports, nil, handleAPICourseStudents))
+	setHandler("/api/v1/users", allowTokens(readExports, nil, handleAPIUsers))
+	setHandler("/api/v1/users/{id}", allowTokens(readExports, nil, handleAPIUser))
+	setHandler("/api/v1/users/{id}/choices", allowTokens(readExports, nil, handleAPIChoices))
+	setHandler("/api/v1/users/{id}/choices/{course}", handleAPIChoice)
+	setHandler("/api/v1/state", allowTokens(apiTokenScopes, manageState, handleAPIState))
 
 	var l net.Listener
 
@@ -186,12 +224,29 @@ func main() {
 		log.Fatalln(err)
 	}
 
+	slog.Info("setting up course groups")
+	err = setupCourseGroups(context.Background())
+	if err != nil {
+		log.Fatalln(err)
+	}
+
 	slog.Info("setting up courses")
 	err = setupCourses(context.Background())
 	if err != nil {
 		log.Fatalln(err)
 	}
 
+	slog.Info("setting up schedules")
+	err = setupSchedules(context.Background())
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	slog.Info("setting up OpenID Connect")
+	if err := setupOIDC(context.Background()); err != nil {
+		log.Fatalln(err)
+	}
+
 	slog.Info("setting up JWKS")
 	if err := setupJwks(); err != nil {
 		log.Fatalln(err)
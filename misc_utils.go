@@ -22,9 +22,13 @@ package main
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"log/slog"
 	"net/http"
+	"strings"
 )
 
 func wstr(w http.ResponseWriter, code int, msg string) {
@@ -40,6 +44,20 @@ func wstr(w http.ResponseWriter, code int, msg string) {
 	}
 }
 
+func writeJSON(w http.ResponseWriter, code int, v any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return wrapError(errCannotMarshalJSON, err)
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	_, err = w.Write(b)
+	if err != nil {
+		return wrapError(errHTTPWrite, err)
+	}
+	return nil
+}
+
 /*
  * Generate a random url-safe string.
  * Note that the "sz" parameter specifies the number of bytes taken from the
@@ -56,6 +74,15 @@ func randomString(sz int) (string, error) {
 	return base64.RawURLEncoding.EncodeToString(r), nil
 }
 
+/*
+ * API tokens and session cookies are only stored as hashes, so that the
+ * database alone does not let anyone act as their owners.
+ */
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
 func getKeysOfMap[K comparable, V any](i map[K]V) []K {
 	o := make([]K, 0, len(i))
 	for k := range i {
@@ -63,3 +90,27 @@ func getKeysOfMap[K comparable, V any](i map[K]V) []K {
 	}
 	return o
 }
+
+/*
+ * Student IDs are not provided by the identity provider, but come from the
+ * roster, in users.student_id. Students who are not on the roster have them
+ * taken from their email addresses instead.
+ */
+func studentIDOf(rosterStudentID string, email string) string {
+	if rosterStudentID != "" {
+		return rosterStudentID
+	}
+	return studentIDFromEmail(email)
+}
+
+/*
+ * Student email addresses are in the form of s12345@example.org.
+ */
+func studentIDFromEmail(email string) string {
+	before, _, found := strings.Cut(email, "@")
+	if !found {
+		return email
+	}
+	studentID, _ := strings.CutPrefix(before, "s")
+	return studentID
+}
@@ -0,0 +1,153 @@
+/*
+ * OpenID Connect discovery and claims
+ *
+ * Copyright (C) 2024  Runxi Yu <https://runxiyu.org>
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const oidcDiscoveryTimeout = 10 * time.Second
+
+/*
+ * The fields we use from the provider's OpenID Connect discovery document,
+ * see https://openid.net/specs/openid-connect-discovery-1_0.html.
+ */
+type oidcDiscoveryT struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JwksURI               string `json:"jwks_uri"`
+}
+
+/*
+ * Fetch the issuer's discovery document and fill in the endpoints that were
+ * not set explicitly in the configuration file, unless all that are needed
+ * were set.
+ */
+func setupOIDC(ctx context.Context) error {
+	if config.Auth.Authorize != "" && config.Auth.Jwks != "" {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, oidcDiscoveryTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(
+		ctx,
+		http.MethodGet,
+		config.Auth.Issuer+"/.well-known/openid-configuration",
+		nil,
+	)
+	if err != nil {
+		return wrapError(errCannotDiscoverOIDC, err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return wrapError(errCannotDiscoverOIDC, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return wrapAny(errCannotDiscoverOIDC, resp.Status)
+	}
+
+	var discovery oidcDiscoveryT
+	err = json.NewDecoder(resp.Body).Decode(&discovery)
+	if err != nil {
+		return wrapError(errCannotDiscoverOIDC, err)
+	}
+
+	if strings.TrimSuffix(discovery.Issuer, "/") != config.Auth.Issuer {
+		return fmt.Errorf(
+			"%w: %q does not match the configured %q",
+			errOIDCIssuerMismatch,
+			discovery.Issuer,
+			config.Auth.Issuer,
+		)
+	}
+
+	for _, endpoint := range []struct {
+		name  string
+		value string
+		dest  *string
+	}{
+		{"authorization_endpoint", discovery.AuthorizationEndpoint, &config.Auth.Authorize},
+		{"jwks_uri", discovery.JwksURI, &config.Auth.Jwks},
+		{"token_endpoint", discovery.TokenEndpoint, &config.Auth.Token},
+	} {
+		if *endpoint.dest != "" {
+			continue
+		}
+		if endpoint.value == "" && endpoint.name != "token_endpoint" {
+			return wrapAny(errCannotDiscoverOIDC, "missing "+endpoint.name)
+		}
+		*endpoint.dest = endpoint.value
+	}
+
+	return nil
+}
+
+/*
+ * These are the user's details taken from the claims in the ID token, under
+ * the claim names set in auth.claims.
+ */
+type userClaimsT struct {
+	ID     string
+	Name   string
+	Email  string
+	Groups []string
+}
+
+/*
+ * Providers differ in whether a user with a single group gets an array or a
+ * plain string, so both are accepted for the groups claim. Other claims that
+ * are missing or have the wrong type are read as empty strings, except for
+ * the user ID, which must be present.
+ */
+func getUserClaims(claims jwt.MapClaims) (userClaimsT, error) {
+	var userClaims userClaimsT
+
+	userClaims.ID, _ = claims[config.Auth.Claims.ID].(string)
+	if userClaims.ID == "" {
+		return userClaims, wrapAny(errMissingUserIDClaim, config.Auth.Claims.ID)
+	}
+	userClaims.Name, _ = claims[config.Auth.Claims.Name].(string)
+	userClaims.Email, _ = claims[config.Auth.Claims.Email].(string)
+
+	switch groups := claims[config.Auth.Claims.Groups].(type) {
+	case string:
+		userClaims.Groups = []string{groups}
+	case []any:
+		for _, group := range groups {
+			if g, ok := group.(string); ok {
+				userClaims.Groups = append(userClaims.Groups, g)
+			}
+		}
+	}
+
+	return userClaims, nil
+}
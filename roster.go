@@ -0,0 +1,309 @@
+/*
+ * Student roster
+ *
+ * Copyright (C) 2024  Runxi Yu <https://runxiyu.org>
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+)
+
+/*
+ * Students on the roster who have not logged in yet have a placeholder user
+ * ID, unless their Entra ID object ID is known. The placeholder is replaced
+ * by their object ID when they first log in. Their student ID is kept in
+ * users.student_id either way.
+ */
+const rosterUserIDPrefix = "roster:"
+
+type rosterRowT struct {
+	StudentID  string
+	Name       string
+	Email      string
+	Department string
+	Oid        string /* may be empty */
+}
+
+/*
+ * Parse a roster with the columns "Student ID", "Name", "Email",
+ * "Year Group", and optionally "OID". Every problem found is returned
+ * together.
+ */
+func parseRoster(records [][]string) ([]rosterRowT, []string) {
+	problems := make([]string, 0)
+	if len(records) == 0 {
+		return nil, []string{"the file is empty"}
+	}
+
+	indices := map[string]int{"Student ID": -1, "Name": -1, "Email": -1, "Year Group": -1, "OID": -1}
+	for i, v := range records[0] {
+		if _, ok := indices[strings.TrimSpace(v)]; ok {
+			indices[strings.TrimSpace(v)] = i
+		}
+	}
+	for _, column := range []string{"Student ID", "Name", "Email", "Year Group"} {
+		if indices[column] == -1 {
+			problems = append(problems, fmt.Sprintf("missing column \"%s\"", column))
+		}
+	}
+	if len(problems) != 0 {
+		return nil, problems
+	}
+
+	rows := make([]rosterRowT, 0, len(records)-1)
+	seen := make(map[string]int)
+	for i, line := range records[1:] {
+		lineNumber := i + 2
+		if strings.TrimSpace(strings.Join(line, "")) == "" {
+			continue
+		}
+		if len(line) != len(records[0]) {
+			problems = append(problems, fmt.Sprintf(
+				"line %d has %d fields instead of %d",
+				lineNumber,
+				len(line),
+				len(records[0]),
+			))
+			continue
+		}
+		row := rosterRowT{
+			StudentID:  strings.TrimSpace(line[indices["Student ID"]]),
+			Name:       strings.TrimSpace(line[indices["Name"]]),
+			Email:      strings.TrimSpace(line[indices["Email"]]),
+			Department: strings.TrimSpace(line[indices["Year Group"]]),
+		} //exhaustruct:ignore
+		if indices["OID"] != -1 {
+			row.Oid = strings.TrimSpace(line[indices["OID"]])
+		}
+
+		if row.StudentID == "" {
+			problems = append(problems, fmt.Sprintf("line %d has no student ID", lineNumber))
+		}
+		if row.Name == "" {
+			problems = append(problems, fmt.Sprintf("line %d has no name", lineNumber))
+		}
+		if !strings.Contains(row.Email, "@") {
+			problems = append(problems, fmt.Sprintf("line %d has invalid email \"%s\"", lineNumber, row.Email))
+		}
+		if _, ok := config.Req[row.Department]; !ok {
+			problems = append(problems, fmt.Sprintf(
+				"line %d has invalid year group \"%s\" (allowed year groups: %s)",
+				lineNumber,
+				row.Department,
+				strings.Join(getYearGroups(), ", "),
+			))
+		}
+		if other, ok := seen[row.StudentID]; ok {
+			problems = append(problems, fmt.Sprintf(
+				"line %d has the same student ID \"%s\" as line %d",
+				lineNumber,
+				row.StudentID,
+				other,
+			))
+		} else {
+			seen[row.StudentID] = lineNumber
+		}
+
+		rows = append(rows, row)
+	}
+	return rows, problems
+}
+
+/*
+ * Change a user's ID, which only happens to students on the roster. Their
+ * choices, waitlist entries, preferences, sessions and tokens follow through
+ * the foreign keys, while the audit log and the state history, which are not
+ * tied to users that way, are updated here.
+ */
+func renameUser(ctx context.Context, tx pgx.Tx, from string, to string) error {
+	for _, query := range []string{
+		"UPDATE users SET id = $1 WHERE id = $2",
+		"UPDATE audit SET userid = $1 WHERE userid = $2",
+		"UPDATE audit SET actor = $1 WHERE actor = $2",
+		"UPDATE state_history SET actor = $1 WHERE actor = $2",
+	} {
+		_, err := tx.Exec(ctx, query, to, from)
+		if err != nil {
+			return wrapError(errUnexpectedDBError, err)
+		}
+	}
+	return nil
+}
+
+/*
+ * Add the students on a roster who are not known yet. Students who have
+ * never logged in are updated to match the roster; those who have are left
+ * alone, as their details come from Entra ID, except for their student IDs,
+ * which only the roster has.
+ */
+func importRoster(ctx context.Context, rows []rosterRowT, actor string) (added int, updated int, retErr error) {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return 0, 0, wrapError(errUnexpectedDBError, err)
+	}
+	defer func() {
+		err := tx.Rollback(ctx)
+		if err != nil && (!errors.Is(err, pgx.ErrTxClosed)) {
+			retErr = wrapError(errUnexpectedDBError, err)
+			return
+		}
+	}()
+
+	for _, row := range rows {
+		placeholder := rosterUserIDPrefix + row.StudentID
+		var userID string
+		err := tx.QueryRow(
+			ctx,
+			`SELECT id FROM users
+			WHERE id = $1 OR id = $2 OR student_id = $3 OR lower(email) = lower($4)
+			ORDER BY id = $1 DESC, id = $2 DESC, student_id IS NOT DISTINCT FROM $3 DESC
+			LIMIT 1 FOR UPDATE`,
+			row.Oid,
+			placeholder,
+			row.StudentID,
+			row.Email,
+		).Scan(&userID)
+		if errors.Is(err, pgx.ErrNoRows) {
+			userID = row.Oid
+			if userID == "" {
+				userID = placeholder
+			}
+			_, err = tx.Exec(
+				ctx,
+				"INSERT INTO users (id, name, email, department, student_id, confirmed) VALUES ($1, $2, $3, $4, $5, false)",
+				userID,
+				row.Name,
+				row.Email,
+				row.Department,
+				row.StudentID,
+			)
+			if err != nil {
+				return 0, 0, wrapError(errUnexpectedDBError, err)
+			}
+			added++
+			continue
+		} else if err != nil {
+			return 0, 0, wrapError(errUnexpectedDBError, err)
+		}
+
+		if row.Oid != "" && strings.HasPrefix(userID, rosterUserIDPrefix) {
+			err = renameUser(ctx, tx, userID, row.Oid)
+			if err != nil {
+				return 0, 0, err
+			}
+			userID = row.Oid
+		}
+		studentIDResult, err := tx.Exec(
+			ctx,
+			"UPDATE users SET student_id = $1 WHERE id = $2 AND student_id IS DISTINCT FROM $1",
+			row.StudentID,
+			userID,
+		)
+		if err != nil {
+			return 0, 0, wrapError(errUnexpectedDBError, err)
+		}
+		result, err := tx.Exec(
+			ctx,
+			"UPDATE users SET (name, email, department) = ($1, $2, $3) WHERE id = $4 AND lastlogin IS NULL AND (name, email, department) IS DISTINCT FROM ($1, $2, $3)",
+			row.Name,
+			row.Email,
+			row.Department,
+			userID,
+		)
+		if err != nil {
+			return 0, 0, wrapError(errUnexpectedDBError, err)
+		}
+		if studentIDResult.RowsAffected() != 0 || result.RowsAffected() != 0 {
+			updated++
+		}
+	}
+
+	err = recordAudit(ctx, tx, auditT{
+		Actor:   actor,
+		Action:  auditRoster,
+		Outcome: auditAccepted,
+		Note:    fmt.Sprintf("%d added, %d updated", added, updated),
+	}) //exhaustruct:ignore
+	if err != nil {
+		return 0, 0, err
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return 0, 0, wrapError(errUnexpectedDBError, err)
+	}
+	return added, updated, nil
+}
+
+/*
+ * When a student on the roster first logs in, the placeholder user created
+ * for them is given their Entra ID object ID, matched by their email. This
+ * does nothing if there is no such placeholder.
+ */
+func adoptRosterUser(ctx context.Context, oid string, email string) (retErr error) {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return wrapError(errUnexpectedDBError, err)
+	}
+	defer func() {
+		err := tx.Rollback(ctx)
+		if err != nil && (!errors.Is(err, pgx.ErrTxClosed)) {
+			retErr = wrapError(errUnexpectedDBError, err)
+			return
+		}
+	}()
+
+	var exists bool
+	err = tx.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM users WHERE id = $1)", oid).Scan(&exists)
+	if err != nil {
+		return wrapError(errUnexpectedDBError, err)
+	}
+	if exists {
+		return nil
+	}
+
+	var placeholder string
+	err = tx.QueryRow(
+		ctx,
+		"SELECT id FROM users WHERE starts_with(id, $1) AND lower(email) = lower($2) FOR UPDATE",
+		rosterUserIDPrefix,
+		email,
+	).Scan(&placeholder)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil
+	} else if err != nil {
+		return wrapError(errUnexpectedDBError, err)
+	}
+
+	err = renameUser(ctx, tx, placeholder, oid)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return wrapError(errUnexpectedDBError, err)
+	}
+	return nil
+}
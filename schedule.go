@@ -0,0 +1,231 @@
+/*
+ * Scheduled state transitions
+ *
+ * Copyright (C) 2024  Runxi Yu <https://runxiyu.org>
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+type scheduleT struct {
+	ID    int
+	Time  time.Time
+	State stateT
+}
+
+var scheduleTimers sync.Map /* int, *time.Timer */
+
+/*
+ * Read scheduled state transitions from the database and start their timers.
+ * Transitions that should have happened while we were not running are
+ * applied immediately, in order. This should be called during setup, after
+ * the state is loaded.
+ */
+func setupSchedules(ctx context.Context) error {
+	schedules, err := getSchedules(ctx)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, schedule := range schedules {
+		if schedule.Time.After(now) {
+			armSchedule(schedule)
+			continue
+		}
+		err := fireSchedule(ctx, schedule)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+ * Get all scheduled state transitions, the earliest first.
+ */
+func getSchedules(ctx context.Context) ([]scheduleT, error) {
+	rows, err := db.Query(
+		ctx,
+		"SELECT id, time, state FROM schedules ORDER BY time, id",
+	)
+	if err != nil {
+		return nil, wrapError(errUnexpectedDBError, err)
+	}
+	schedules, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (scheduleT, error) {
+		var schedule scheduleT
+		var unixTime int64
+		err := row.Scan(&schedule.ID, &unixTime, &schedule.State)
+		schedule.Time = time.Unix(unixTime, 0)
+		return schedule, err
+	})
+	if err != nil {
+		return nil, wrapError(errUnexpectedDBError, err)
+	}
+	return schedules, nil
+}
+
+func armSchedule(schedule scheduleT) {
+	timer := time.AfterFunc(time.Until(schedule.Time), func() {
+		defer func() {
+			if e := recover(); e != nil {
+				slog.Error("panic", "arg", e)
+			}
+		}()
+		err := fireSchedule(context.Background(), schedule)
+		if err != nil {
+			slog.Error(
+				"schedule",
+				"id", schedule.ID,
+				"error", err,
+			)
+		}
+	})
+	scheduleTimers.Store(schedule.ID, timer)
+}
+
+/*
+ * Apply a scheduled state transition. The schedule is deleted in the same
+ * transaction as the state is saved, so if that fails, the schedule is kept
+ * and applied when we next start.
+ */
+func fireSchedule(ctx context.Context, schedule scheduleT) (retErr error) {
+	scheduleTimers.Delete(schedule.ID)
+	if !schedule.State.valid() {
+		return wrapAny(errInvalidState, uint32(schedule.State))
+	}
+
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return wrapError(errUnexpectedDBError, err)
+	}
+	defer func() {
+		err := tx.Rollback(ctx)
+		if err != nil && (!errors.Is(err, pgx.ErrTxClosed)) {
+			retErr = wrapError(errUnexpectedDBError, err)
+			return
+		}
+	}()
+
+	ct, err := tx.Exec(
+		ctx,
+		"DELETE FROM schedules WHERE id = $1",
+		schedule.ID,
+	)
+	if err != nil {
+		return wrapError(errUnexpectedDBError, err)
+	}
+	if ct.RowsAffected() == 0 {
+		/* Canceled just as it was about to fire */
+		return nil
+	}
+	slog.Info(
+		"schedule",
+		"id", schedule.ID,
+		"state", schedule.State.String(),
+	)
+	err = writeStateValue(ctx, tx, schedule.State, auditActorSchedule)
+	if err != nil {
+		return err
+	}
+	err = tx.Commit(ctx)
+	if err != nil {
+		return wrapError(errUnexpectedDBError, err)
+	}
+
+	applyState(schedule.State)
+	return propagateNextSchedule(ctx)
+}
+
+func addSchedule(ctx context.Context, t time.Time, newState stateT) error {
+	if !newState.valid() {
+		return errInvalidState
+	}
+	schedule := scheduleT{
+		ID:    0,
+		Time:  t,
+		State: newState,
+	}
+	err := db.QueryRow(
+		ctx,
+		"INSERT INTO schedules (time, state) VALUES ($1, $2) RETURNING id",
+		t.Unix(),
+		uint32(newState),
+	).Scan(&schedule.ID)
+	if err != nil {
+		return wrapError(errUnexpectedDBError, err)
+	}
+	armSchedule(schedule)
+	return propagateNextSchedule(ctx)
+}
+
+func cancelSchedule(ctx context.Context, id int) error {
+	_timer, ok := scheduleTimers.LoadAndDelete(id)
+	if ok {
+		timer, ok := _timer.(*time.Timer)
+		if !ok {
+			panic("scheduleTimers has non-\"*time.Timer\" items")
+		}
+		timer.Stop()
+	}
+	ct, err := db.Exec(
+		ctx,
+		"DELETE FROM schedules WHERE id = $1",
+		id,
+	)
+	if err != nil {
+		return wrapError(errUnexpectedDBError, err)
+	}
+	if ct.RowsAffected() == 0 {
+		return wrapAny(errNoSuchSchedule, id)
+	}
+	return propagateNextSchedule(ctx)
+}
+
+/*
+ * Get the message that tells students about the next scheduled state
+ * transition, for their countdown. It is "T <state> <unix time>", or just
+ * "T" if there isn't any.
+ */
+func getNextScheduleMessage(ctx context.Context) (string, error) {
+	schedules, err := getSchedules(ctx)
+	if err != nil {
+		return "", err
+	}
+	if len(schedules) == 0 {
+		return "T", nil
+	}
+	return fmt.Sprintf("T %s %d", schedules[0].State, schedules[0].Time.Unix()), nil
+}
+
+func propagateNextSchedule(ctx context.Context) error {
+	msg, err := getNextScheduleMessage(ctx)
+	if err != nil {
+		return err
+	}
+	propagate(msg)
+	return nil
+}
@@ -1,5 +1,5 @@
 /*
- * Session checking functions
+ * Sessions
  *
  * Copyright (C) 2024  Runxi Yu <https://runxiyu.org>
  * SPDX-License-Identifier: AGPL-3.0-or-later
@@ -21,13 +21,37 @@
 package main
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"net"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/jackc/pgx/v5"
 )
 
+/*
+ * Each login creates a session of its own, so that a user may be logged in
+ * on several devices at once. Only a hash of the session cookie is stored.
+ */
+type sessionT struct {
+	Created   time.Time
+	Expires   time.Time
+	UserAgent string
+	IP        string
+}
+
+/*
+ * Requests are authenticated by the session cookie, or by an API token in the
+ * Authorization header.
+ */
 func getUserInfoFromRequest(req *http.Request) (userID, username, department string, retErr error) {
+	if token, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer "); ok {
+		return getUserInfoFromToken(req, strings.TrimSpace(token))
+	}
+
 	sessionCookie, err := req.Cookie("session")
 	if errors.Is(err, http.ErrNoCookie) {
 		retErr = wrapError(errNoCookie, err)
@@ -39,8 +63,12 @@ func getUserInfoFromRequest(req *http.Request) (userID, username, department str
 
 	err = db.QueryRow(
 		req.Context(),
-		"SELECT id, name, department FROM users WHERE session = $1",
-		sessionCookie.Value,
+		`SELECT u.id, u.name, u.department
+		FROM sessions s
+		JOIN users u ON u.id = s.userid
+		WHERE s.hash = $1 AND s.expr > $2`,
+		hashSecret(sessionCookie.Value),
+		time.Now().Unix(),
 	).Scan(&userID, &username, &department)
 	if err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
@@ -52,3 +80,166 @@ func getUserInfoFromRequest(req *http.Request) (userID, username, department str
 	}
 	return
 }
+
+/*
+ * Start a new session for the user and set its cookie. Expired sessions of
+ * all users are cleaned up at the same time.
+ */
+func createSession(w http.ResponseWriter, req *http.Request, userID string) error {
+	cookieValue, err := randomString(tokenLength)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	expr := now.Add(time.Duration(config.Auth.Expr) * time.Second)
+
+	ip, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		ip = req.RemoteAddr
+	}
+
+	_, err = db.Exec(
+		req.Context(),
+		"DELETE FROM sessions WHERE expr <= $1",
+		now.Unix(),
+	)
+	if err != nil {
+		return wrapError(errUnexpectedDBError, err)
+	}
+
+	_, err = db.Exec(
+		req.Context(),
+		"INSERT INTO sessions (hash, userid, created, expr, useragent, ip) VALUES ($1, $2, $3, $4, $5, $6)",
+		hashSecret(cookieValue),
+		userID,
+		now.Unix(),
+		expr.Unix(),
+		req.UserAgent(),
+		ip,
+	)
+	if err != nil {
+		return wrapError(errUnexpectedDBError, err)
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     "session",
+		Value:    cookieValue,
+		SameSite: http.SameSiteLaxMode,
+		HttpOnly: true,
+		Secure:   config.Prod,
+		Expires:  expr,
+	}) //exhaustruct:ignore
+
+	return nil
+}
+
+/*
+ * End the session the request was made with, if any, and clear its cookie.
+ */
+func endSession(w http.ResponseWriter, req *http.Request) error {
+	sessionCookie, err := req.Cookie("session")
+	if errors.Is(err, http.ErrNoCookie) {
+		return nil
+	} else if err != nil {
+		return wrapError(errCannotCheckCookie, err)
+	}
+
+	_, err = db.Exec(
+		req.Context(),
+		"DELETE FROM sessions WHERE hash = $1",
+		hashSecret(sessionCookie.Value),
+	)
+	if err != nil {
+		return wrapError(errUnexpectedDBError, err)
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     "session",
+		SameSite: http.SameSiteLaxMode,
+		HttpOnly: true,
+		Secure:   config.Prod,
+		MaxAge:   -1,
+	}) //exhaustruct:ignore
+
+	return nil
+}
+
+/*
+ * The user's sessions that have not expired, the newest first.
+ */
+func getUserSessions(ctx context.Context, userID string) ([]sessionT, error) {
+	rows, err := db.Query(
+		ctx,
+		"SELECT created, expr, useragent, ip FROM sessions WHERE userid = $1 AND expr > $2 ORDER BY created DESC",
+		userID,
+		time.Now().Unix(),
+	)
+	if err != nil {
+		return nil, wrapError(errUnexpectedDBError, err)
+	}
+	sessions, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (sessionT, error) {
+		var session sessionT
+		var created, expr int64
+		err := row.Scan(&created, &expr, &session.UserAgent, &session.IP)
+		session.Created = time.Unix(created, 0)
+		session.Expires = time.Unix(expr, 0)
+		return session, err
+	})
+	if err != nil {
+		return nil, wrapError(errUnexpectedDBError, err)
+	}
+	return sessions, nil
+}
+
+/*
+ * End all of the user's sessions and close the WebSocket connections opened
+ * through them, including those to manage students' choices, returning how
+ * many sessions there were. Connections opened by staff to manage the user's
+ * own choices are left alone.
+ */
+func revokeUserSessions(ctx context.Context, userID string, actor string) (count int64, retErr error) {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return 0, wrapError(errUnexpectedDBError, err)
+	}
+	defer func() {
+		err := tx.Rollback(ctx)
+		if err != nil && (!errors.Is(err, pgx.ErrTxClosed)) {
+			retErr = wrapError(errUnexpectedDBError, err)
+			return
+		}
+	}()
+
+	ct, err := tx.Exec(ctx, "DELETE FROM sessions WHERE userid = $1", userID)
+	if err != nil {
+		return 0, wrapError(errUnexpectedDBError, err)
+	}
+	err = recordAudit(ctx, tx, auditT{
+		UserID:  userID,
+		Actor:   actor,
+		Action:  auditSessionsRevoke,
+		Outcome: auditAccepted,
+		Note:    fmt.Sprintf("%d sessions", ct.RowsAffected()),
+	}) //exhaustruct:ignore
+	if err != nil {
+		return 0, err
+	}
+	err = tx.Commit(ctx)
+	if err != nil {
+		return 0, wrapError(errUnexpectedDBError, err)
+	}
+
+	actorPool.Range(func(key, value interface{}) bool {
+		cancel, ok := key.(*context.CancelFunc)
+		if !ok {
+			panic("actorPool has non-\"*context.CancelFunc\" keys")
+		}
+		if value == userID {
+			(*cancel)()
+		}
+		return true
+	})
+
+	return ct.RowsAffected(), nil
+}
@@ -21,10 +21,28 @@
 package main
 
 import (
+	"errors"
 	"log/slog"
 	"net/http"
 )
 
+/*
+ * Handlers may return -1 for errors from authenticating the request, which
+ * should not be reported as internal server errors.
+ */
+func defaultErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, errNoCookie),
+		errors.Is(err, errNoSuchUser),
+		errors.Is(err, errInvalidToken):
+		return http.StatusUnauthorized
+	case errors.Is(err, errTokenScope):
+		return http.StatusForbidden
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
 func setHandler(pattern string, handler func(http.ResponseWriter, *http.Request) (string, int, error)) {
 	http.HandleFunc(pattern, func(w http.ResponseWriter, req *http.Request) {
 		defer func() {
@@ -36,7 +54,7 @@ func setHandler(pattern string, handler func(http.ResponseWriter, *http.Request)
 		msg, statusCode, err := handler(w, req)
 		if err != nil {
 			if statusCode == -1 || statusCode == 0 {
-				statusCode = 500
+				statusCode = defaultErrorStatus(err)
 			}
 			slog.Error(
 				"handler",
@@ -0,0 +1,648 @@
+/*
+ * Read and write CSV, XLSX and ODS spreadsheets
+ *
+ * Copyright (C) 2024  Runxi Yu <https://runxiyu.org>
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+/*
+ * Spreadsheets are handled with the standard library only. Only what is
+ * needed for simple tables is supported: the first sheet of an uploaded
+ * workbook is read as text, and exported workbooks only contain text cells.
+ */
+
+/*
+ * Limits on uploaded workbooks, far beyond any course list or roster, so that
+ * a crafted file could not exhaust memory by being large, by being highly
+ * compressed or by placing a cell far away.
+ */
+const (
+	spreadsheetMaxUploadSize = 16 << 20 /* bytes of the request body */
+	spreadsheetMaxPartSize   = 64 << 20 /* uncompressed bytes of each XML part */
+	spreadsheetMaxRows       = 16384
+	spreadsheetMaxColumns    = 256
+)
+
+/*
+ * Read a spreadsheet uploaded in the given form field, returning its content
+ * and file name. The file is read into memory as a whole, so the request body
+ * is limited to spreadsheetMaxUploadSize. The returned status is only
+ * meaningful if there is an error.
+ */
+func readUploadedSpreadsheet(w http.ResponseWriter, req *http.Request, field string) ([]byte, string, int, error) {
+	req.Body = http.MaxBytesReader(w, req.Body, spreadsheetMaxUploadSize)
+	file, fileHeader, err := req.FormFile(field)
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			return nil, "", http.StatusRequestEntityTooLarge, wrapError(errSpreadsheetTooLarge, err)
+		}
+		return nil, "", http.StatusBadRequest, wrapError(errFormNoFile, err)
+	}
+	defer file.Close()
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return nil, "", http.StatusBadRequest, wrapError(errCannotReadUpload, err)
+	}
+	return data, fileHeader.Filename, -1, nil
+}
+
+/*
+ * Read the first sheet of a CSV, XLSX or ODS file, telling them apart by
+ * their content rather than their name or the Content-Type that the browser
+ * sent.
+ */
+func readSpreadsheet(data []byte) ([][]string, error) {
+	if bytes.HasPrefix(data, []byte("PK\x03\x04")) {
+		zipReader, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			return nil, wrapError(errUnsupportedSpreadsheet, err)
+		}
+		files := make(map[string]*zip.File, len(zipReader.File))
+		for _, f := range zipReader.File {
+			files[f.Name] = f
+		}
+		if _, ok := files["xl/workbook.xml"]; ok {
+			return readXLSX(files)
+		}
+		if _, ok := files["content.xml"]; ok {
+			return readODS(files["content.xml"])
+		}
+		return nil, errUnsupportedSpreadsheet
+	}
+
+	if !utf8.Valid(data) || bytes.IndexByte(data, 0) != -1 {
+		return nil, errUnsupportedSpreadsheet
+	}
+	/* Excel writes a byte order mark at the start of CSV files */
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+	csvReader := csv.NewReader(bytes.NewReader(data))
+	/* Lines with the wrong number of fields are reported by the caller */
+	csvReader.FieldsPerRecord = -1
+	records, err := csvReader.ReadAll()
+	if err != nil {
+		return nil, wrapError(errCannotReadCSV, err)
+	}
+	return records, nil
+}
+
+func readZipFile(f *zip.File) ([]byte, error) {
+	r, err := f.Open()
+	if err != nil {
+		return nil, wrapError(errUnsupportedSpreadsheet, err)
+	}
+	defer r.Close()
+	data, err := io.ReadAll(io.LimitReader(r, spreadsheetMaxPartSize+1))
+	if err != nil {
+		return nil, wrapError(errUnsupportedSpreadsheet, err)
+	}
+	if len(data) > spreadsheetMaxPartSize {
+		return nil, wrapAny(errSpreadsheetTooLarge, f.Name)
+	}
+	return data, nil
+}
+
+/*
+ * Cells in XLSX files refer to columns with letters, e.g. "AB12".
+ */
+func xlsxColumnIndex(ref string) int {
+	index := 0
+	for _, r := range ref {
+		if r < 'A' || r > 'Z' {
+			break
+		}
+		index = index*26 + int(r-'A') + 1
+	}
+	return index - 1
+}
+
+func xlsxColumnName(index int) string {
+	name := ""
+	for index++; index > 0; index = (index - 1) / 26 {
+		name = string(rune('A'+(index-1)%26)) + name
+	}
+	return name
+}
+
+/*
+ * Rich text is stored as runs, each with their own text.
+ */
+type xlsxStringT struct {
+	T    string `xml:"t"`
+	Runs []struct {
+		T string `xml:"t"`
+	} `xml:"r"`
+}
+
+func (s xlsxStringT) String() string {
+	if len(s.Runs) == 0 {
+		return s.T
+	}
+	var b strings.Builder
+	for _, run := range s.Runs {
+		b.WriteString(run.T)
+	}
+	return b.String()
+}
+
+func readXLSX(files map[string]*zip.File) ([][]string, error) {
+	unmarshal := func(name string, v any) error {
+		f, ok := files[name]
+		if !ok {
+			return wrapAny(errUnsupportedSpreadsheet, "missing "+name)
+		}
+		data, err := readZipFile(f)
+		if err != nil {
+			return err
+		}
+		err = xml.Unmarshal(data, v)
+		if err != nil {
+			return wrapError(errUnsupportedSpreadsheet, err)
+		}
+		return nil
+	}
+
+	var workbook struct {
+		Sheets []struct {
+			RelID string `xml:"http://schemas.openxmlformats.org/officeDocument/2006/relationships id,attr"`
+		} `xml:"sheets>sheet"`
+	}
+	err := unmarshal("xl/workbook.xml", &workbook)
+	if err != nil {
+		return nil, err
+	}
+	if len(workbook.Sheets) == 0 {
+		return nil, wrapAny(errUnsupportedSpreadsheet, "no sheets")
+	}
+
+	var rels struct {
+		Relationships []struct {
+			ID     string `xml:"Id,attr"`
+			Target string `xml:"Target,attr"`
+		} `xml:"Relationship"`
+	}
+	err = unmarshal("xl/_rels/workbook.xml.rels", &rels)
+	if err != nil {
+		return nil, err
+	}
+	var sheetName string
+	for _, rel := range rels.Relationships {
+		if rel.ID == workbook.Sheets[0].RelID {
+			if strings.HasPrefix(rel.Target, "/") {
+				sheetName = strings.TrimPrefix(rel.Target, "/")
+			} else {
+				sheetName = path.Join("xl", rel.Target)
+			}
+		}
+	}
+
+	var sharedStrings struct {
+		Items []xlsxStringT `xml:"si"`
+	}
+	if _, ok := files["xl/sharedStrings.xml"]; ok {
+		err = unmarshal("xl/sharedStrings.xml", &sharedStrings)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var worksheet struct {
+		Rows []struct {
+			R     int `xml:"r,attr"`
+			Cells []struct {
+				R      string      `xml:"r,attr"`
+				T      string      `xml:"t,attr"`
+				V      string      `xml:"v"`
+				Inline xlsxStringT `xml:"is"`
+			} `xml:"c"`
+		} `xml:"sheetData>row"`
+	}
+	err = unmarshal(sheetName, &worksheet)
+	if err != nil {
+		return nil, err
+	}
+
+	records := make([][]string, 0, len(worksheet.Rows))
+	for _, row := range worksheet.Rows {
+		if row.R > spreadsheetMaxRows || len(records) >= spreadsheetMaxRows {
+			return nil, wrapAny(errSpreadsheetTooLarge, "too many rows")
+		}
+		/* Empty rows are omitted, but line numbers should still match */
+		for row.R > len(records)+1 {
+			records = append(records, []string{})
+		}
+		record := make([]string, 0, len(row.Cells))
+		for _, cell := range row.Cells {
+			if cell.R != "" {
+				column := xlsxColumnIndex(cell.R)
+				if column >= spreadsheetMaxColumns {
+					return nil, wrapAny(errSpreadsheetTooLarge, "too many columns")
+				}
+				for column > len(record) {
+					record = append(record, "")
+				}
+			}
+			if len(record) >= spreadsheetMaxColumns {
+				return nil, wrapAny(errSpreadsheetTooLarge, "too many columns")
+			}
+			var value string
+			switch cell.T {
+			case "s":
+				i, err := strconv.Atoi(cell.V)
+				if err != nil || i < 0 || i >= len(sharedStrings.Items) {
+					return nil, wrapAny(errUnsupportedSpreadsheet, "invalid shared string "+cell.V)
+				}
+				value = sharedStrings.Items[i].String()
+			case "inlineStr":
+				value = cell.Inline.String()
+			case "b":
+				value = strings.ToUpper(strconv.FormatBool(cell.V == "1"))
+			default:
+				value = cell.V
+			}
+			record = append(record, value)
+		}
+		records = append(records, record)
+	}
+	return padRecords(records), nil
+}
+
+/*
+ * Repeated rows and cells are capped, as spreadsheets often repeat empty
+ * ones to the end of the sheet.
+ */
+const odsMaxRepeat = 1024
+
+func readODS(f *zip.File) ([][]string, error) {
+	const (
+		tableNS  = "urn:oasis:names:tc:opendocument:xmlns:table:1.0"
+		textNS   = "urn:oasis:names:tc:opendocument:xmlns:text:1.0"
+		officeNS = "urn:oasis:names:tc:opendocument:xmlns:office:1.0"
+	)
+
+	data, err := readZipFile(f)
+	if err != nil {
+		return nil, err
+	}
+
+	repeat := func(e xml.StartElement, name string) int {
+		for _, attr := range e.Attr {
+			if attr.Name.Space == tableNS && attr.Name.Local == name {
+				n, err := strconv.Atoi(attr.Value)
+				if err == nil && n > 0 {
+					return min(n, odsMaxRepeat)
+				}
+			}
+		}
+		return 1
+	}
+
+	records := make([][]string, 0)
+	var record []string
+	var cell strings.Builder
+	var inTable, inCell bool
+	var paragraphs, annotationDepth, rowRepeat, cellRepeat, emptyRows, emptyCells int
+
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, wrapError(errUnsupportedSpreadsheet, err)
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			switch {
+			case t.Name.Space == tableNS && t.Name.Local == "table":
+				inTable = true
+			case !inTable:
+			case t.Name.Space == officeNS && t.Name.Local == "annotation":
+				annotationDepth++
+			case annotationDepth > 0:
+			case t.Name.Space == tableNS && t.Name.Local == "table-row":
+				record = make([]string, 0)
+				rowRepeat = repeat(t, "number-rows-repeated")
+				emptyCells = 0
+			case t.Name.Space == tableNS && (t.Name.Local == "table-cell" || t.Name.Local == "covered-table-cell"):
+				inCell = true
+				cell.Reset()
+				paragraphs = 0
+				cellRepeat = repeat(t, "number-columns-repeated")
+			case inCell && t.Name.Space == textNS && t.Name.Local == "p":
+				if paragraphs > 0 {
+					cell.WriteString("\n")
+				}
+				paragraphs++
+			case inCell && t.Name.Space == textNS && t.Name.Local == "s":
+				spaces := 1
+				for _, attr := range t.Attr {
+					if attr.Name.Space == textNS && attr.Name.Local == "c" {
+						n, err := strconv.Atoi(attr.Value)
+						if err == nil && n > 0 {
+							spaces = min(n, odsMaxRepeat)
+						}
+					}
+				}
+				cell.WriteString(strings.Repeat(" ", spaces))
+			case inCell && t.Name.Space == textNS && t.Name.Local == "tab":
+				cell.WriteString("\t")
+			case inCell && t.Name.Space == textNS && t.Name.Local == "line-break":
+				cell.WriteString("\n")
+			}
+		case xml.CharData:
+			if inCell && annotationDepth == 0 && paragraphs > 0 {
+				cell.Write(t)
+			}
+		case xml.EndElement:
+			switch {
+			case !inTable:
+			case t.Name.Space == officeNS && t.Name.Local == "annotation":
+				annotationDepth--
+			case annotationDepth > 0:
+			case t.Name.Space == tableNS && t.Name.Local == "table":
+				/* Only the first sheet is read */
+				return padRecords(records), nil
+			case t.Name.Space == tableNS && (t.Name.Local == "table-cell" || t.Name.Local == "covered-table-cell"):
+				inCell = false
+				if cell.Len() == 0 {
+					emptyCells += cellRepeat
+					break
+				}
+				if len(record)+emptyCells+cellRepeat > spreadsheetMaxColumns {
+					return nil, wrapAny(errSpreadsheetTooLarge, "too many columns")
+				}
+				for ; emptyCells > 0; emptyCells-- {
+					record = append(record, "")
+				}
+				for range cellRepeat {
+					record = append(record, cell.String())
+				}
+			case t.Name.Space == tableNS && t.Name.Local == "table-row":
+				if len(record) == 0 {
+					emptyRows += rowRepeat
+					break
+				}
+				if len(records)+emptyRows+rowRepeat > spreadsheetMaxRows {
+					return nil, wrapAny(errSpreadsheetTooLarge, "too many rows")
+				}
+				for ; emptyRows > 0; emptyRows-- {
+					records = append(records, []string{})
+				}
+				for range rowRepeat {
+					records = append(records, record)
+				}
+			}
+		}
+	}
+	return padRecords(records), nil
+}
+
+/*
+ * Spreadsheets omit trailing empty cells, so rows are padded to the same
+ * width, as they would be in a CSV file.
+ */
+func padRecords(records [][]string) [][]string {
+	width := 0
+	for _, record := range records {
+		width = max(width, len(record))
+	}
+	for i, record := range records {
+		for len(record) < width {
+			record = append(record, "")
+		}
+		records[i] = record
+	}
+	return records
+}
+
+type sheetT struct {
+	Name string
+	Rows [][]string
+}
+
+/*
+ * Sheet names are limited to 31 characters, may not contain some characters,
+ * and must be unique.
+ */
+func xlsxSheetNames(sheets []sheetT) []string {
+	names := make([]string, 0, len(sheets))
+	seen := make(map[string]struct{})
+	for _, sheet := range sheets {
+		name := strings.Map(func(r rune) rune {
+			if strings.ContainsRune("[]:*?/\\", r) {
+				return '_'
+			}
+			return r
+		}, sheet.Name)
+		if name == "" {
+			name = "Sheet"
+		}
+		if utf8.RuneCountInString(name) > 31 {
+			name = string([]rune(name)[:31])
+		}
+		base := name
+		for i := 2; ; i++ {
+			if _, ok := seen[name]; !ok {
+				break
+			}
+			suffix := fmt.Sprintf(" (%d)", i)
+			name = string([]rune(base)[:min(utf8.RuneCountInString(base), 31-len(suffix))]) + suffix
+		}
+		seen[name] = struct{}{}
+		names = append(names, name)
+	}
+	return names
+}
+
+func writeXLSX(w io.Writer, sheets []sheetT) error {
+	zipWriter := zip.NewWriter(w)
+	create := func(name string, content string) error {
+		f, err := zipWriter.Create(name)
+		if err != nil {
+			return wrapError(errHTTPWrite, err)
+		}
+		_, err = io.WriteString(f, content)
+		if err != nil {
+			return wrapError(errHTTPWrite, err)
+		}
+		return nil
+	}
+	escape := func(s string) string {
+		var b strings.Builder
+		_ = xml.EscapeText(&b, []byte(s))
+		return b.String()
+	}
+	const header = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` + "\n"
+
+	var contentTypes, workbook, workbookRels strings.Builder
+	contentTypes.WriteString(header + `<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types"><Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/><Default Extension="xml" ContentType="application/xml"/><Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>`)
+	workbook.WriteString(header + `<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships"><sheets>`)
+	workbookRels.WriteString(header + `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">`)
+
+	for i, name := range xlsxSheetNames(sheets) {
+		n := i + 1
+		fmt.Fprintf(&contentTypes, `<Override PartName="/xl/worksheets/sheet%d.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>`, n)
+		fmt.Fprintf(&workbook, `<sheet name="%s" sheetId="%d" r:id="rId%d"/>`, escape(name), n, n)
+		fmt.Fprintf(&workbookRels, `<Relationship Id="rId%d" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet%d.xml"/>`, n, n)
+
+		var sheet strings.Builder
+		sheet.WriteString(header + `<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`)
+		for r, row := range sheets[i].Rows {
+			fmt.Fprintf(&sheet, `<row r="%d">`, r+1)
+			for c, value := range row {
+				fmt.Fprintf(
+					&sheet,
+					`<c r="%s%d" t="inlineStr"><is><t xml:space="preserve">%s</t></is></c>`,
+					xlsxColumnName(c),
+					r+1,
+					escape(value),
+				)
+			}
+			sheet.WriteString(`</row>`)
+		}
+		sheet.WriteString(`</sheetData></worksheet>`)
+		err := create(fmt.Sprintf("xl/worksheets/sheet%d.xml", n), sheet.String())
+		if err != nil {
+			return err
+		}
+	}
+
+	contentTypes.WriteString(`</Types>`)
+	workbook.WriteString(`</sheets></workbook>`)
+	workbookRels.WriteString(`</Relationships>`)
+	for _, f := range []struct{ name, content string }{
+		{"[Content_Types].xml", contentTypes.String()},
+		{"_rels/.rels", header + `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/></Relationships>`},
+		{"xl/workbook.xml", workbook.String()},
+		{"xl/_rels/workbook.xml.rels", workbookRels.String()},
+	} {
+		err := create(f.name, f.content)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := zipWriter.Close()
+	if err != nil {
+		return wrapError(errHTTPWrite, err)
+	}
+	return nil
+}
+
+/*
+ * Year groups such as Y9 and Y10 should be sorted by their numbers, so
+ * shorter names are sorted first.
+ */
+func compareSheetNames(a, b string) int {
+	if len(a) != len(b) {
+		return len(a) - len(b)
+	}
+	return strings.Compare(a, b)
+}
+
+/*
+ * Write an export as CSV, or as XLSX if the "format" query parameter is
+ * "xlsx". In XLSX, the rows are split into sheets by the value in the
+ * sheetColumn, ordered by sheetOrder and then by name, with the header on
+ * every sheet. If sheetColumn is -1, everything is in one sheet.
+ */
+func writeExport(
+	w http.ResponseWriter,
+	req *http.Request,
+	basename string,
+	header []string,
+	rows [][]string,
+	sheetColumn int,
+	sheetOrder []string,
+) error {
+	if req.FormValue("format") != "xlsx" {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", "attachment;filename="+basename+".csv")
+		csvWriter := csv.NewWriter(w)
+		err := csvWriter.Write(header)
+		if err != nil {
+			return wrapError(errHTTPWrite, err)
+		}
+		err = csvWriter.WriteAll(rows)
+		if err != nil {
+			return wrapError(errHTTPWrite, err)
+		}
+		csvWriter.Flush()
+		err = csvWriter.Error()
+		if err != nil {
+			return wrapError(errHTTPWrite, err)
+		}
+		return nil
+	}
+
+	sheets := make([]sheetT, 0)
+	sheetIndices := make(map[string]int)
+	if sheetColumn == -1 {
+		sheets = append(sheets, sheetT{basename, [][]string{header}})
+	}
+	for _, row := range rows {
+		name := ""
+		if sheetColumn != -1 {
+			name = row[sheetColumn]
+		}
+		i, ok := sheetIndices[name]
+		if !ok && sheetColumn != -1 {
+			i = len(sheets)
+			sheetIndices[name] = i
+			sheets = append(sheets, sheetT{name, [][]string{header}})
+		}
+		sheets[i].Rows = append(sheets[i].Rows, row)
+	}
+	slices.SortStableFunc(sheets, func(a, b sheetT) int {
+		ai, bi := slices.Index(sheetOrder, a.Name), slices.Index(sheetOrder, b.Name)
+		switch {
+		case ai != -1 && bi != -1:
+			return ai - bi
+		case ai != -1:
+			return -1
+		case bi != -1:
+			return 1
+		}
+		return compareSheetNames(a.Name, b.Name)
+	})
+	if len(sheets) == 0 {
+		sheets = append(sheets, sheetT{basename, [][]string{header}})
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet")
+	w.Header().Set("Content-Disposition", "attachment;filename="+basename+".xlsx")
+	return writeXLSX(w, sheets)
+}
@@ -0,0 +1,265 @@
+/*
+ * Tests for reading and writing spreadsheets
+ *
+ * Copyright (C) 2024  Runxi Yu <https://runxiyu.org>
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func makeZip(t *testing.T, files map[string]string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zipWriter := zip.NewWriter(&buf)
+	for name, content := range files {
+		f, err := zipWriter.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = f.Write([]byte(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := zipWriter.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func makeODS(t *testing.T, table string) []byte {
+	t.Helper()
+	return makeZip(t, map[string]string{
+		"mimetype": "application/vnd.oasis.opendocument.spreadsheet",
+		"content.xml": `<?xml version="1.0" encoding="UTF-8"?>` +
+			`<office:document-content` +
+			` xmlns:office="urn:oasis:names:tc:opendocument:xmlns:office:1.0"` +
+			` xmlns:table="urn:oasis:names:tc:opendocument:xmlns:table:1.0"` +
+			` xmlns:text="urn:oasis:names:tc:opendocument:xmlns:text:1.0">` +
+			`<office:body><office:spreadsheet>` +
+			`<table:table table:name="Sheet1">` + table + `</table:table>` +
+			`<table:table table:name="Sheet2"><table:table-row><table:table-cell><text:p>Ignored</text:p></table:table-cell></table:table-row></table:table>` +
+			`</office:spreadsheet></office:body></office:document-content>`,
+	})
+}
+
+func makeXLSX(t *testing.T, sheetData string) []byte {
+	t.Helper()
+	return makeZip(t, map[string]string{
+		"xl/workbook.xml": `<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"` +
+			` xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">` +
+			`<sheets><sheet name="Sheet1" sheetId="1" r:id="rId1"/></sheets></workbook>`,
+		"xl/_rels/workbook.xml.rels": `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+			`<Relationship Id="rId1" Target="worksheets/sheet1.xml"/></Relationships>`,
+		"xl/worksheets/sheet1.xml": `<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">` +
+			`<sheetData>` + sheetData + `</sheetData></worksheet>`,
+	})
+}
+
+func TestReadSpreadsheet(t *testing.T) {
+	t.Parallel()
+
+	odsCell := func(attrs string, text string) string {
+		return `<table:table-cell` + attrs + `><text:p>` + text + `</text:p></table:table-cell>`
+	}
+	odsRow := func(attrs string, cells ...string) string {
+		return `<table:table-row` + attrs + `>` + strings.Join(cells, "") + `</table:table-row>`
+	}
+
+	tests := []struct {
+		name    string
+		data    []byte
+		want    [][]string
+		wantErr error
+	}{
+		{
+			name: "csv",
+			data: []byte("id,name\r\ns1,\"Doe, Jane\"\r\n"),
+			want: [][]string{{"id", "name"}, {"s1", "Doe, Jane"}},
+		},
+		{
+			name: "csv with byte order mark",
+			data: []byte("\xef\xbb\xbfid,name\ns1,Jane\n"),
+			want: [][]string{{"id", "name"}, {"s1", "Jane"}},
+		},
+		{
+			name:    "binary",
+			data:    []byte("\x00\x01\x02"),
+			wantErr: errUnsupportedSpreadsheet,
+		},
+		{
+			name:    "zip without a workbook",
+			data:    makeZip(t, map[string]string{"hello.txt": "hello"}),
+			wantErr: errUnsupportedSpreadsheet,
+		},
+		{
+			name: "ods with repeated and covered cells",
+			data: makeODS(t, odsRow("",
+				odsCell("", "Name"),
+				odsCell(` table:number-columns-repeated="2"`, "x"),
+				`<table:table-cell table:number-columns-repeated="3"/>`,
+				odsCell("", "End"),
+				`<table:table-cell table:number-columns-repeated="16384"/>`,
+			)+odsRow("",
+				odsCell(` table:number-columns-spanned="2"`, "Merged"),
+				`<table:covered-table-cell/>`,
+				`<table:table-cell><office:annotation><text:p>Comment</text:p></office:annotation><text:p>C</text:p></table:table-cell>`,
+			)+odsRow(` table:number-rows-repeated="2"`,
+				`<table:table-cell table:number-columns-repeated="1024"/>`,
+			)+odsRow("",
+				odsCell("", `a<text:s text:c="2"/>b`),
+			)+odsRow(` table:number-rows-repeated="1048576"`,
+				`<table:table-cell table:number-columns-repeated="16384"/>`,
+			)),
+			want: [][]string{
+				{"Name", "x", "x", "", "", "", "End"},
+				{"Merged", "", "C", "", "", "", ""},
+				{"", "", "", "", "", "", ""},
+				{"", "", "", "", "", "", ""},
+				{"a  b", "", "", "", "", "", ""},
+			},
+		},
+		{
+			name: "ods with too many rows",
+			data: makeODS(t, strings.Repeat(
+				odsRow(` table:number-rows-repeated="1024"`, odsCell("", "x")),
+				spreadsheetMaxRows/1024+1,
+			)),
+			wantErr: errSpreadsheetTooLarge,
+		},
+		{
+			name: "ods with too many columns",
+			data: makeODS(t, odsRow("",
+				`<table:table-cell table:number-columns-repeated="1024"/>`,
+				odsCell("", "x"),
+			)),
+			wantErr: errSpreadsheetTooLarge,
+		},
+		{
+			name: "ods that decompresses to too much",
+			data: makeODS(t, odsRow("",
+				odsCell("", strings.Repeat(" ", spreadsheetMaxPartSize)),
+			)),
+			wantErr: errSpreadsheetTooLarge,
+		},
+		{
+			name: "xlsx with omitted rows and cells",
+			data: makeXLSX(t,
+				`<row r="1"><c r="A1" t="inlineStr"><is><t>id</t></is></c><c r="C1" t="b"><v>1</v></c></row>`+
+					`<row r="3"><c r="B3"><v>42</v></c></row>`,
+			),
+			want: [][]string{
+				{"id", "", "TRUE"},
+				{"", "", ""},
+				{"", "42", ""},
+			},
+		},
+		{
+			name:    "xlsx with a distant row",
+			data:    makeXLSX(t, `<row r="1048576"><c r="A1048576"><v>1</v></c></row>`),
+			wantErr: errSpreadsheetTooLarge,
+		},
+		{
+			name:    "xlsx with a distant column",
+			data:    makeXLSX(t, `<row r="1"><c r="XFD1"><v>1</v></c></row>`),
+			wantErr: errSpreadsheetTooLarge,
+		},
+		{
+			name:    "xlsx with an invalid shared string",
+			data:    makeXLSX(t, `<row r="1"><c r="A1" t="s"><v>3</v></c></row>`),
+			wantErr: errUnsupportedSpreadsheet,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			got, err := readSpreadsheet(test.data)
+			if test.wantErr != nil {
+				if !errors.Is(err, test.wantErr) {
+					t.Fatalf("got error %v, want %v", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.EqualFunc(got, test.want, slices.Equal) {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestXLSXRoundTrip(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		rows [][]string
+	}{
+		{
+			name: "plain",
+			rows: [][]string{{"id", "name"}, {"s1", "Jane"}},
+		},
+		{
+			name: "special characters",
+			rows: [][]string{
+				{"<tag>", "a & b", `"quoted"`},
+				{"  padded  ", "two\nlines", "中文"},
+			},
+		},
+		{
+			name: "empty cells",
+			rows: [][]string{{"", "b", ""}, {"", "", ""}, {"a", "", "c"}},
+		},
+		{
+			name: "wide",
+			rows: [][]string{strings.Split(strings.Repeat("x,", 29)+"x", ",")},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			var buf bytes.Buffer
+			err := writeXLSX(&buf, []sheetT{
+				{Name: "First", Rows: test.rows},
+				{Name: "Second", Rows: [][]string{{"ignored"}}},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := readSpreadsheet(buf.Bytes())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.EqualFunc(got, test.rows, slices.Equal) {
+				t.Errorf("got %q, want %q", got, test.rows)
+			}
+		})
+	}
+}
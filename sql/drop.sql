@@ -1,4 +1,12 @@
+DROP TABLE preferences;
+DROP TABLE waitlist;
 DROP TABLE choices;
+DROP TABLE tokens;
+DROP TABLE sessions;
 DROP TABLE users;
 DROP TABLE courses;
+DROP TABLE groups;
+DROP TABLE schedules;
+DROP TABLE state_history;
+DROP TABLE audit;
 DROP TABLE misc;
@@ -3,30 +3,98 @@ CREATE TABLE courses (
 	nmax INTEGER NOT NULL,
 	title TEXT NOT NULL,
 	teacher TEXT NOT NULL,
+	teacher_email TEXT NOT NULL DEFAULT '', -- may be empty; lets the teacher see the course roster
 	location TEXT NOT NULL,
 	ctype TEXT NOT NULL,
 	cgroup TEXT NOT NULL,
 	course_id TEXT NOT NULL,
-	section_id TEXT NOT NULL
+	section_id TEXT NOT NULL,
+	eligible TEXT[] NOT NULL DEFAULT '{}', -- year groups, empty if unrestricted
+	retired BOOLEAN NOT NULL DEFAULT false
+);
+CREATE TABLE groups (
+	handle TEXT PRIMARY KEY NOT NULL,
+	name TEXT NOT NULL,
+	ord INTEGER NOT NULL
 );
 CREATE TABLE users (
 	id TEXT PRIMARY KEY NOT NULL, -- should be UUID
 	name TEXT NOT NULL,
 	email TEXT NOT NULL,
 	department TEXT NOT NULL,
-	session TEXT,
-	expr BIGINT, -- seconds
-	confirmed BOOLEAN NOT NULL
+	student_id TEXT, -- from the roster, NULL if not on it
+	confirmed BOOLEAN NOT NULL,
+	lastlogin BIGINT -- seconds, NULL if never logged in
 );
 CREATE TABLE choices (
 	PRIMARY KEY (userid, courseid),
 	seltime BIGINT NOT NULL, -- microseconds
 	userid TEXT NOT NULL, -- should be UUID
-	FOREIGN KEY(userid) REFERENCES users(id),
+	FOREIGN KEY(userid) REFERENCES users(id) ON UPDATE CASCADE, -- students on the roster are renamed when they first log in
 	courseid INTEGER NOT NULL,
 	FOREIGN KEY(courseid) REFERENCES courses(id),
 	UNIQUE (userid, courseid)
 );
+CREATE TABLE waitlist (
+	PRIMARY KEY (courseid, userid),
+	jointime BIGINT NOT NULL, -- microseconds
+	userid TEXT NOT NULL, -- should be UUID
+	FOREIGN KEY(userid) REFERENCES users(id) ON UPDATE CASCADE, -- students on the roster are renamed when they first log in
+	courseid INTEGER NOT NULL,
+	FOREIGN KEY(courseid) REFERENCES courses(id)
+);
+CREATE TABLE preferences (
+	PRIMARY KEY (userid, courseid),
+	rank INTEGER NOT NULL, -- 1 is the most preferred in the course group
+	userid TEXT NOT NULL, -- should be UUID
+	FOREIGN KEY(userid) REFERENCES users(id) ON UPDATE CASCADE, -- students on the roster are renamed when they first log in
+	courseid INTEGER NOT NULL,
+	FOREIGN KEY(courseid) REFERENCES courses(id)
+);
+CREATE TABLE schedules (
+	id INTEGER GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+	time BIGINT NOT NULL, -- seconds
+	state INTEGER NOT NULL
+);
+CREATE TABLE state_history (
+	id INTEGER GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+	time BIGINT NOT NULL, -- seconds
+	state INTEGER NOT NULL,
+	actor TEXT NOT NULL -- user ID, or "schedule"
+);
+CREATE TABLE tokens (
+	id INTEGER GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+	hash TEXT NOT NULL UNIQUE, -- hex SHA-256 of the token
+	name TEXT NOT NULL,
+	scopes TEXT[] NOT NULL,
+	owner TEXT NOT NULL, -- the staff member the token acts as
+	FOREIGN KEY(owner) REFERENCES users(id) ON UPDATE CASCADE,
+	created BIGINT NOT NULL, -- seconds
+	expr BIGINT, -- seconds, NULL if it never expires
+	lastused BIGINT, -- seconds
+	revoked BOOLEAN NOT NULL DEFAULT false
+);
+CREATE TABLE sessions (
+	id INTEGER GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+	hash TEXT NOT NULL UNIQUE, -- hex SHA-256 of the session cookie
+	userid TEXT NOT NULL,
+	FOREIGN KEY(userid) REFERENCES users(id) ON UPDATE CASCADE ON DELETE CASCADE,
+	created BIGINT NOT NULL, -- seconds
+	expr BIGINT NOT NULL, -- seconds
+	useragent TEXT NOT NULL,
+	ip TEXT NOT NULL
+);
+CREATE TABLE audit (
+	id BIGINT GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+	time BIGINT NOT NULL, -- microseconds
+	userid TEXT, -- the affected student, if any
+	actor TEXT NOT NULL, -- user ID, "waitlist" or "schedule"
+	action TEXT NOT NULL,
+	courseid INTEGER, -- not a foreign key, as courses may be deleted
+	outcome TEXT NOT NULL,
+	conn TEXT NOT NULL, -- WebSocket connection ID, if any
+	note TEXT NOT NULL
+);
 CREATE TABLE misc (
 	key TEXT PRIMARY KEY NOT NULL,
 	value INTEGER NOT NULL
@@ -24,17 +24,94 @@ import (
 	"context"
 	"errors"
 	"sync/atomic"
+	"time"
 
 	"github.com/jackc/pgx/v5"
 )
 
+type stateT uint32
+
+/*
+ * The values are stored in the database, so they must not be changed.
+ */
+const (
+	stateDisabled         stateT = 0 /* Student access is disabled */
+	stateReadOnly         stateT = 1 /* Students have read-only access */
+	stateOpen             stateT = 2 /* Students can choose courses */
+	stateConfirmOnly      stateT = 3 /* Students can only confirm or unconfirm their choices */
+	stateResultsPublished stateT = 4 /* Students have read-only access to their final courses */
+)
+
 /*
- * 0: Student access is disabled
- * 1: Student have read-only access
- * 2: Student can choose courses
+ * All states, in the order that they should be displayed.
  */
+var states = []stateT{
+	stateDisabled,
+	stateReadOnly,
+	stateOpen,
+	stateConfirmOnly,
+	stateResultsPublished,
+}
+
+/*
+ * This is used in URLs and in the WebSocket protocol.
+ */
+func (s stateT) String() string {
+	switch s {
+	case stateDisabled:
+		return "disabled"
+	case stateReadOnly:
+		return "read-only"
+	case stateOpen:
+		return "open"
+	case stateConfirmOnly:
+		return "confirm-only"
+	case stateResultsPublished:
+		return "results-published"
+	default:
+		return "invalid"
+	}
+}
+
+/*
+ * This is used for display.
+ */
+func (s stateT) Label() string {
+	switch s {
+	case stateDisabled:
+		return "Disabled"
+	case stateReadOnly:
+		return "Read-only"
+	case stateOpen:
+		return "Open"
+	case stateConfirmOnly:
+		return "Confirm-only"
+	case stateResultsPublished:
+		return "Results published"
+	default:
+		return "Invalid"
+	}
+}
+
+func (s stateT) valid() bool {
+	return s <= stateResultsPublished
+}
+
+func parseState(name string) (stateT, error) {
+	for _, s := range states {
+		if s.String() == name {
+			return s, nil
+		}
+	}
+	return stateDisabled, wrapAny(errInvalidState, name)
+}
+
 var state uint32 /* atomic */
 
+func getState() stateT {
+	return stateT(atomic.LoadUint32(&state))
+}
+
 func loadState() error {
 	var _state uint32
 	err := db.QueryRow(
@@ -43,7 +120,7 @@ func loadState() error {
 	).Scan(&_state)
 	if err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
-			_state = 0
+			_state = uint32(stateDisabled)
 			_, err := db.Exec(
 				context.Background(),
 				"INSERT INTO misc(key, value) VALUES ('state', $1)",
@@ -56,44 +133,130 @@ func loadState() error {
 			return wrapError(errUnexpectedDBError, err)
 		}
 	}
+	if !stateT(_state).valid() {
+		return wrapAny(errInvalidState, _state)
+	}
 	atomic.StoreUint32(&state, _state)
 	return nil
 }
 
-func saveStateValue(ctx context.Context, newState uint32) error {
-	_, err := db.Exec(
+/*
+ * Save the state and record the transition in the state history, along with
+ * the actor, which is the ID of the user who changed it or auditActorSchedule.
+ */
+func saveStateValue(ctx context.Context, newState stateT, actor string) (retErr error) {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return wrapError(errUnexpectedDBError, err)
+	}
+	defer func() {
+		err := tx.Rollback(ctx)
+		if err != nil && (!errors.Is(err, pgx.ErrTxClosed)) {
+			retErr = wrapError(errUnexpectedDBError, err)
+			return
+		}
+	}()
+
+	err = writeStateValue(ctx, tx, newState, actor)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return wrapError(errUnexpectedDBError, err)
+	}
+	return nil
+}
+
+/*
+ * Like saveStateValue, but in a transaction that the caller commits.
+ */
+func writeStateValue(ctx context.Context, q dbQuerier, newState stateT, actor string) error {
+	_, err := q.Exec(
 		ctx,
 		"UPDATE misc SET value = $1 WHERE key = 'state'",
-		newState,
+		uint32(newState),
 	)
 	if err != nil {
 		return wrapError(errUnexpectedDBError, err)
 	}
+	_, err = q.Exec(
+		ctx,
+		"INSERT INTO state_history (time, state, actor) VALUES ($1, $2, $3)",
+		time.Now().Unix(),
+		uint32(newState),
+		actor,
+	)
+	if err != nil {
+		return wrapError(errUnexpectedDBError, err)
+	}
+	return recordAudit(ctx, q, auditT{
+		Actor:   actor,
+		Action:  auditState,
+		Outcome: auditAccepted,
+		Note:    newState.String(),
+	}) //exhaustruct:ignore
+}
+
+func setState(ctx context.Context, newState stateT, actor string) error {
+	if !newState.valid() {
+		return errInvalidState
+	}
+	err := saveStateValue(ctx, newState, actor)
+	if err != nil {
+		return err
+	}
+	applyState(newState)
 	return nil
 }
 
-func setState(ctx context.Context, newState uint32) error {
-	switch newState {
-	case 0:
+/*
+ * Switch to a state that has already been saved, and tell everyone.
+ */
+func applyState(newState stateT) {
+	atomic.StoreUint32(&state, uint32(newState))
+	if newState == stateDisabled {
 		cancelPool.Range(func(_, value interface{}) bool {
 			cancel, ok := value.(*context.CancelFunc)
 			if !ok {
-				panic("chanPool has non-\"*contect.CancelFunc\" values")
+				panic("cancelPool has non-\"*context.CancelFunc\" values")
 			}
 			(*cancel)()
-			return false
+			return true
 		})
-	case 1:
-		propagate("STOP")
-	case 2:
-		propagate("START")
-	default:
-		return errInvalidState
+	} else {
+		propagate("S " + newState.String())
+	}
+}
+
+type stateHistoryT struct {
+	Time  time.Time
+	State stateT
+	Actor string
+}
+
+/*
+ * Get the state history, the latest first. The actor is replaced with the
+ * user's name where possible.
+ */
+func getStateHistory(ctx context.Context) ([]stateHistoryT, error) {
+	rows, err := db.Query(
+		ctx,
+		"SELECT h.time, h.state, COALESCE(u.name, h.actor) FROM state_history h LEFT JOIN users u ON u.id = h.actor ORDER BY h.id DESC",
+	)
+	if err != nil {
+		return nil, wrapError(errUnexpectedDBError, err)
 	}
-	err := saveStateValue(ctx, newState)
+	history, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (stateHistoryT, error) {
+		var entry stateHistoryT
+		var unixTime int64
+		err := row.Scan(&unixTime, &entry.State, &entry.Actor)
+		entry.Time = time.Unix(unixTime, 0)
+		return entry, err
+	})
 	if err != nil {
-		return err
+		return nil, wrapError(errUnexpectedDBError, err)
 	}
-	atomic.StoreUint32(&state, newState)
-	return nil
+	return history, nil
 }
@@ -0,0 +1,203 @@
+/*
+ * Per-student status report
+ *
+ * Copyright (C) 2024  Runxi Yu <https://runxiyu.org>
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+type studentReportT struct {
+	UserID        string
+	Name          string
+	Email         string
+	StudentID     string
+	Department    string
+	Confirmed     bool
+	LastLogin     time.Time      /* zero if never */
+	Types         map[string]int /* number of courses chosen of each type */
+	MissingGroups []string       /* course groups without a chosen course */
+}
+
+/*
+ * Students who have never logged in only appear if they are on the roster.
+ */
+func (student *studentReportT) status() string {
+	switch {
+	case student.LastLogin.IsZero():
+		return "never logged in"
+	case !student.Confirmed:
+		return "logged in but not confirmed"
+	default:
+		return "confirmed"
+	}
+}
+
+/*
+ * Whether the student has chosen at least the minimum number of courses of
+ * every type for their year group.
+ */
+func (student *studentReportT) meetsMinimums() bool {
+	for _, courseType := range getCourseTypeHandles() {
+		requirement, err := getCourseTypeRequirementForYearGroup(student.Department, courseType)
+		if err != nil {
+			continue
+		}
+		if student.Types[courseType] < requirement.Min {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+ * Year groups in the configuration file, in their natural order.
+ */
+func getYearGroups() []string {
+	yearGroups := make([]string, 0, len(config.Req))
+	for yearGroup := range config.Req {
+		yearGroups = append(yearGroups, yearGroup)
+	}
+	slices.SortFunc(yearGroups, compareSheetNames)
+	return yearGroups
+}
+
+/*
+ * Empty or nil fields match every student.
+ */
+type studentFilterT struct {
+	UserID    string
+	YearGroup string
+	Confirmed *bool
+	LoggedIn  *bool
+}
+
+/*
+ * List every student matching the filter with their choices summarized,
+ * sorted by year group and name.
+ */
+func getStudentReport(ctx context.Context, filter studentFilterT) ([]*studentReportT, error) {
+	rows, err := db.Query(
+		ctx,
+		`SELECT id, name, email, COALESCE(student_id, ''), department, confirmed, COALESCE(lastlogin, 0)
+		FROM users
+		WHERE department != ALL($1)
+		AND ($2 = '' OR department = $2)
+		AND ($3::BOOLEAN IS NULL OR confirmed = $3)
+		AND ($4::BOOLEAN IS NULL OR (lastlogin IS NOT NULL) = $4)
+		AND ($5 = '' OR id = $5)`,
+		nonStudentDepartments,
+		filter.YearGroup,
+		filter.Confirmed,
+		filter.LoggedIn,
+		filter.UserID,
+	)
+	if err != nil {
+		return nil, wrapError(errUnexpectedDBError, err)
+	}
+	students, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (*studentReportT, error) {
+		var student studentReportT
+		var lastLogin int64
+		err := row.Scan(
+			&student.UserID,
+			&student.Name,
+			&student.Email,
+			&student.StudentID,
+			&student.Department,
+			&student.Confirmed,
+			&lastLogin,
+		)
+		student.StudentID = studentIDOf(student.StudentID, student.Email)
+		if lastLogin != 0 {
+			student.LastLogin = time.Unix(lastLogin, 0)
+		}
+		student.Types = make(map[string]int)
+		return &student, err
+	})
+	if err != nil {
+		return nil, wrapError(errUnexpectedDBError, err)
+	}
+	slices.SortFunc(students, func(a, b *studentReportT) int {
+		if a.Department != b.Department {
+			return compareSheetNames(a.Department, b.Department)
+		}
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	byUserID := make(map[string]*studentReportT, len(students))
+	for _, student := range students {
+		byUserID[student.UserID] = student
+	}
+	groups := make(map[string]map[string]struct{}, len(students))
+
+	rows, err = db.Query(ctx, "SELECT userid, courseid FROM choices WHERE $1 = '' OR userid = $1", filter.UserID)
+	if err != nil {
+		return nil, wrapError(errUnexpectedDBError, err)
+	}
+	defer rows.Close()
+	for {
+		if !rows.Next() {
+			err := rows.Err()
+			if err != nil {
+				return nil, wrapError(errUnexpectedDBError, err)
+			}
+			break
+		}
+		var userID string
+		var courseID int
+		err := rows.Scan(&userID, &courseID)
+		if err != nil {
+			return nil, wrapError(errUnexpectedDBError, err)
+		}
+		student, ok := byUserID[userID]
+		if !ok {
+			continue
+		}
+		_course, ok := courses.Load(courseID)
+		if !ok {
+			return nil, wrapAny(errNoSuchCourse, courseID)
+		}
+		course, ok := _course.(*courseT)
+		if !ok {
+			panic("courses map has non-\"*courseT\" items")
+		}
+		student.Types[course.Info().Type]++
+		if groups[userID] == nil {
+			groups[userID] = make(map[string]struct{})
+		}
+		groups[userID][course.Info().Group] = struct{}{}
+	}
+
+	for _, student := range students {
+		student.MissingGroups = make([]string, 0)
+		for _, group := range getCourseGroupHandles() {
+			if _, ok := groups[student.UserID][group]; !ok {
+				student.MissingGroups = append(student.MissingGroups, group)
+			}
+		}
+	}
+
+	return students, nil
+}
@@ -0,0 +1,287 @@
+/*
+ * API tokens for scripts and other systems
+ *
+ * Copyright (C) 2024  Runxi Yu <https://runxiyu.org>
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+/*
+ * API tokens let scripts act as the staff member who created them, but only
+ * for what their scopes allow. Only a hash of each token is stored.
+ */
+const (
+	scopeReadExports   = "read-exports"
+	scopeManageCourses = "manage-courses"
+	scopeManageState   = "manage-state"
+)
+
+var apiTokenScopes = []string{scopeReadExports, scopeManageCourses, scopeManageState}
+
+const apiTokenPrefix = "cca_"
+
+type apiTokenT struct {
+	ID        int
+	Name      string
+	Scopes    []string
+	OwnerName string
+	Created   time.Time
+	Expires   time.Time /* zero if never */
+	LastUsed  time.Time /* zero if never */
+}
+
+/*
+ * Create a token and return it. This is the only time that the token itself
+ * is available.
+ */
+func createAPIToken(
+	ctx context.Context,
+	name string,
+	tokenScopes []string,
+	expires time.Time,
+	owner string,
+) (token string, retErr error) {
+	if name == "" {
+		return "", wrapAny(errInvalidTokenDetails, "missing name")
+	}
+	if len(tokenScopes) == 0 {
+		return "", wrapAny(errInvalidTokenDetails, "no scopes")
+	}
+	for _, scope := range tokenScopes {
+		if !slices.Contains(apiTokenScopes, scope) {
+			return "", wrapAny(errInvalidTokenDetails, "unknown scope "+scope)
+		}
+	}
+
+	random, err := randomString(tokenLength)
+	if err != nil {
+		return "", err
+	}
+	token = apiTokenPrefix + random
+
+	var expr *int64
+	if !expires.IsZero() {
+		e := expires.Unix()
+		expr = &e
+	}
+
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return "", wrapError(errUnexpectedDBError, err)
+	}
+	defer func() {
+		err := tx.Rollback(ctx)
+		if err != nil && (!errors.Is(err, pgx.ErrTxClosed)) {
+			retErr = wrapError(errUnexpectedDBError, err)
+			return
+		}
+	}()
+
+	var id int
+	err = tx.QueryRow(
+		ctx,
+		"INSERT INTO tokens (hash, name, scopes, owner, created, expr) VALUES ($1, $2, $3, $4, $5, $6) RETURNING id",
+		hashSecret(token),
+		name,
+		tokenScopes,
+		owner,
+		time.Now().Unix(),
+		expr,
+	).Scan(&id)
+	if err != nil {
+		return "", wrapError(errUnexpectedDBError, err)
+	}
+	err = recordAudit(ctx, tx, auditT{
+		Actor:   owner,
+		Action:  auditTokenCreate,
+		Outcome: auditAccepted,
+		Note:    fmt.Sprintf("%d %s (%s)", id, name, strings.Join(tokenScopes, " ")),
+	}) //exhaustruct:ignore
+	if err != nil {
+		return "", err
+	}
+	err = tx.Commit(ctx)
+	if err != nil {
+		return "", wrapError(errUnexpectedDBError, err)
+	}
+	return token, nil
+}
+
+func revokeAPIToken(ctx context.Context, id int, actor string) (retErr error) {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return wrapError(errUnexpectedDBError, err)
+	}
+	defer func() {
+		err := tx.Rollback(ctx)
+		if err != nil && (!errors.Is(err, pgx.ErrTxClosed)) {
+			retErr = wrapError(errUnexpectedDBError, err)
+			return
+		}
+	}()
+
+	var name string
+	err = tx.QueryRow(
+		ctx,
+		"UPDATE tokens SET revoked = true WHERE id = $1 AND NOT revoked RETURNING name",
+		id,
+	).Scan(&name)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return wrapAny(errNoSuchToken, id)
+	} else if err != nil {
+		return wrapError(errUnexpectedDBError, err)
+	}
+	err = recordAudit(ctx, tx, auditT{
+		Actor:   actor,
+		Action:  auditTokenRevoke,
+		Outcome: auditAccepted,
+		Note:    fmt.Sprintf("%d %s", id, name),
+	}) //exhaustruct:ignore
+	if err != nil {
+		return err
+	}
+	err = tx.Commit(ctx)
+	if err != nil {
+		return wrapError(errUnexpectedDBError, err)
+	}
+	return nil
+}
+
+/*
+ * Tokens that have not been revoked, including expired ones, the newest
+ * first.
+ */
+func getAPITokens(ctx context.Context) ([]apiTokenT, error) {
+	rows, err := db.Query(
+		ctx,
+		`SELECT t.id, t.name, t.scopes, COALESCE(u.name, t.owner), t.created, COALESCE(t.expr, 0), COALESCE(t.lastused, 0)
+		FROM tokens t
+		LEFT JOIN users u ON u.id = t.owner
+		WHERE NOT t.revoked
+		ORDER BY t.id DESC`,
+	)
+	if err != nil {
+		return nil, wrapError(errUnexpectedDBError, err)
+	}
+	tokens, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (apiTokenT, error) {
+		var token apiTokenT
+		var created, expr, lastUsed int64
+		err := row.Scan(&token.ID, &token.Name, &token.Scopes, &token.OwnerName, &created, &expr, &lastUsed)
+		token.Created = time.Unix(created, 0)
+		if expr != 0 {
+			token.Expires = time.Unix(expr, 0)
+		}
+		if lastUsed != 0 {
+			token.LastUsed = time.Unix(lastUsed, 0)
+		}
+		return token, err
+	})
+	if err != nil {
+		return nil, wrapError(errUnexpectedDBError, err)
+	}
+	return tokens, nil
+}
+
+type tokenScopesKeyT struct{}
+
+/*
+ * Allow API tokens with any of the given scopes to use the handler, with
+ * readScopes for GET requests and writeScopes for everything else. Tokens
+ * may not be used at all with handlers that are not wrapped in this, such as
+ * overrides or managing tokens.
+ */
+func allowTokens(
+	readScopes []string,
+	writeScopes []string,
+	handler func(http.ResponseWriter, *http.Request) (string, int, error),
+) func(http.ResponseWriter, *http.Request) (string, int, error) {
+	return func(w http.ResponseWriter, req *http.Request) (string, int, error) {
+		tokenScopes := writeScopes
+		if req.Method == http.MethodGet || req.Method == http.MethodHead {
+			tokenScopes = readScopes
+		}
+		ctx := context.WithValue(req.Context(), tokenScopesKeyT{}, tokenScopes)
+		return handler(w, req.WithContext(ctx))
+	}
+}
+
+/*
+ * The scopes that allow a token to make the request, as set by allowTokens.
+ */
+func scopesForRequest(req *http.Request) []string {
+	tokenScopes, _ := req.Context().Value(tokenScopesKeyT{}).([]string)
+	return tokenScopes
+}
+
+/*
+ * Tokens act as the staff member who created them, as long as they are still
+ * staff.
+ */
+func getUserInfoFromToken(req *http.Request, token string) (userID, username, department string, retErr error) {
+	var tokenID int
+	var tokenScopes []string
+	err := db.QueryRow(
+		req.Context(),
+		`SELECT t.id, t.scopes, u.id, u.name, u.department
+		FROM tokens t
+		JOIN users u ON u.id = t.owner
+		WHERE t.hash = $1 AND NOT t.revoked AND (t.expr IS NULL OR t.expr > $2)`,
+		hashSecret(token),
+		time.Now().Unix(),
+	).Scan(&tokenID, &tokenScopes, &userID, &username, &department)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", "", "", errInvalidToken
+	} else if err != nil {
+		return "", "", "", wrapError(errUnexpectedDBError, err)
+	}
+	if department != staffDepartment {
+		return "", "", "", errInvalidToken
+	}
+
+	allowed := false
+	for _, scope := range scopesForRequest(req) {
+		if slices.Contains(tokenScopes, scope) {
+			allowed = true
+		}
+	}
+	if !allowed {
+		return "", "", "", wrapAny(errTokenScope, req.Method+" "+req.URL.Path)
+	}
+
+	_, err = db.Exec(
+		req.Context(),
+		"UPDATE tokens SET lastused = $1 WHERE id = $2",
+		time.Now().Unix(),
+		tokenID,
+	)
+	if err != nil {
+		return "", "", "", wrapError(errUnexpectedDBError, err)
+	}
+	return userID, username, department, nil
+}
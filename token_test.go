@@ -0,0 +1,86 @@
+/*
+ * Tests for API tokens
+ *
+ * Copyright (C) 2024  Runxi Yu <https://runxiyu.org>
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+func TestAllowTokens(t *testing.T) {
+	t.Parallel()
+
+	readScopes := []string{scopeReadExports}
+	writeScopes := []string{scopeManageCourses, scopeManageState}
+
+	tests := []struct {
+		name   string
+		method string
+		wrap   bool
+		want   []string
+	}{
+		{"get", http.MethodGet, true, readScopes},
+		{"head", http.MethodHead, true, readScopes},
+		{"post", http.MethodPost, true, writeScopes},
+		{"put", http.MethodPut, true, writeScopes},
+		{"delete", http.MethodDelete, true, writeScopes},
+		{"get without allowTokens", http.MethodGet, false, nil},
+		{"post without allowTokens", http.MethodPost, false, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			var got []string
+			handler := func(w http.ResponseWriter, req *http.Request) (string, int, error) {
+				_ = w
+				got = scopesForRequest(req)
+				return "", -1, nil
+			}
+			if test.wrap {
+				handler = allowTokens(readScopes, writeScopes, handler)
+			}
+			_, _, err := handler(httptest.NewRecorder(), httptest.NewRequest(test.method, "/", nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(got, test.want) {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+
+	t.Run("write-only", func(t *testing.T) {
+		t.Parallel()
+		var got []string
+		handler := allowTokens(nil, writeScopes, func(w http.ResponseWriter, req *http.Request) (string, int, error) {
+			_ = w
+			got = scopesForRequest(req)
+			return "", -1, nil
+		})
+		_, _, _ = handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+		if got != nil {
+			t.Errorf("got %q for a GET request, want none", got)
+		}
+	})
+}
@@ -0,0 +1,55 @@
+/*
+ * Waitlist utilities
+ *
+ * Copyright (C) 2024  Runxi Yu <https://runxiyu.org>
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+)
+
+/*
+ * Get the number of students waiting for each course. Courses without
+ * anyone waiting are omitted.
+ */
+func getWaitlistLengths(ctx context.Context) (map[int]int, error) {
+	rows, err := db.Query(
+		ctx,
+		"SELECT courseid, COUNT(*) FROM waitlist GROUP BY courseid",
+	)
+	if err != nil {
+		return nil, wrapError(errUnexpectedDBError, err)
+	}
+	defer rows.Close()
+
+	lengths := make(map[int]int)
+	for rows.Next() {
+		var courseID, length int
+		err := rows.Scan(&courseID, &length)
+		if err != nil {
+			return nil, wrapError(errUnexpectedDBError, err)
+		}
+		lengths[courseID] = length
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, wrapError(errUnexpectedDBError, err)
+	}
+	return lengths, nil
+}
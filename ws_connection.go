@@ -44,18 +44,29 @@ var usemCount int64 /* atomic */
 
 /*
  * The actual logic in handling the connection, after authentication has been
- * completed.
+ * completed. The actor is who the changes made through the connection are
+ * recorded as being made by, which is the user themselves unless a staff
+ * member is managing their choices.
  */
 func handleConn(
 	ctx context.Context,
 	c *websocket.Conn,
 	userID string,
 	department string,
+	actor string,
 ) error {
 	send := make(chan string, config.Perf.SendQ)
 	chanPool.Store(userID, &send)
 	defer chanPool.CompareAndDelete(userID, &send)
 
+	/*
+	 * The connection ID identifies the connection in the audit log.
+	 */
+	connID, err := randomString(2)
+	if err != nil {
+		return err
+	}
+
 	newCtx, newCancel := context.WithCancel(ctx)
 
 	_cancel, ok := cancelPool.Load(userID)
@@ -72,12 +83,13 @@ func handleConn(
 		cancelPool.CompareAndDelete(userID, &newCancel)
 	}()
 
+	actorPool.Store(&newCancel, actor)
+	defer actorPool.Delete(&newCancel)
+
 	/* TODO: Tell the user their current choices here. Deprecate HELLO. */
 
 	usems := make(map[int]*usemT)
 
-	/* TODO: Check if the LoadUint32 here is a bit too much overhead */
-	atomic.AddInt64(&usemCount, int64(atomic.LoadUint32(&numCourses)))
 	courses.Range(func(key, value interface{}) bool {
 		/* TODO: Remember to change this too when changing the courseID type */
 		courseID, ok := key.(int)
@@ -94,6 +106,11 @@ func handleConn(
 		usems[courseID] = usem
 		return true
 	})
+	/*
+	 * Courses may be added or retired while the connection is open, so
+	 * the number of usems is counted here instead of using numCourses.
+	 */
+	atomic.AddInt64(&usemCount, int64(len(usems)))
 
 	defer func() {
 		courses.Range(func(key, value interface{}) bool {
@@ -105,7 +122,7 @@ func handleConn(
 			course.Usems.Delete(userID)
 			return true
 		})
-		atomic.AddInt64(&usemCount, -int64(atomic.LoadUint32(&numCourses)))
+		atomic.AddInt64(&usemCount, -int64(len(usems)))
 	}()
 
 	usemParent := make(chan int)
@@ -138,13 +155,6 @@ func handleConn(
 		}()
 	}
 
-	var userCourseGroups userCourseGroupsT = make(map[string]struct{})
-	var userCourseTypes userCourseTypesT = make(map[string]int)
-	err := populateUserCourseTypesAndGroups(newCtx, &userCourseTypes, &userCourseGroups, userID)
-	if err != nil {
-		return err
-	}
-
 	/*
 	 * Later we need to select from recv and send and perform the
 	 * corresponding action. But we can't just select from c.Read because
@@ -291,8 +301,9 @@ func handleConn(
 					c,
 					mar,
 					userID,
-					&userCourseGroups,
-					&userCourseTypes,
+					department,
+					actor,
+					connID,
 				)
 				if err != nil {
 					return err
@@ -303,8 +314,46 @@ func handleConn(
 					c,
 					mar,
 					userID,
-					&userCourseGroups,
-					&userCourseTypes,
+					actor,
+					connID,
+				)
+				if err != nil {
+					return err
+				}
+			case "W":
+				err := messageWait(
+					newCtx,
+					c,
+					mar,
+					userID,
+					department,
+					actor,
+					connID,
+				)
+				if err != nil {
+					return err
+				}
+			case "NW":
+				err := messageUnwait(
+					newCtx,
+					c,
+					mar,
+					userID,
+					actor,
+					connID,
+				)
+				if err != nil {
+					return err
+				}
+			case "P":
+				err := messagePreferences(
+					newCtx,
+					c,
+					mar,
+					userID,
+					department,
+					actor,
+					connID,
 				)
 				if err != nil {
 					return err
@@ -316,7 +365,8 @@ func handleConn(
 					mar,
 					userID,
 					department,
-					&userCourseTypes,
+					actor,
+					connID,
 				)
 				if err != nil {
 					return err
@@ -327,6 +377,8 @@ func handleConn(
 					c,
 					mar,
 					userID,
+					actor,
+					connID,
 				)
 				if err != nil {
 					return err
@@ -340,4 +392,11 @@ func handleConn(
 
 var cancelPool sync.Map /* string, *context.CancelFunc */
 
+/*
+ * The user whose session opened each connection, which differs from the
+ * user the connection is for when staff manage students' choices, so that
+ * connections end along with the sessions that opened them.
+ */
+var actorPool sync.Map /* *context.CancelFunc, string */
+
 var chanPool sync.Map /* string, *chan string */
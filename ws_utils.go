@@ -142,6 +142,32 @@ func propagate(msg string) {
 	})
 }
 
+/*
+ * Send a message to the user's connection, if they are connected. The
+ * returned bool is false if the message could not be queued.
+ */
+func sendToUser(userID string, msg string) bool {
+	_ch, ok := chanPool.Load(userID)
+	if !ok {
+		return false
+	}
+	ch, ok := _ch.(*chan string)
+	if !ok {
+		panic("chanPool has non-\"*chan string\" key")
+	}
+	select {
+	case *ch <- msg:
+		return true
+	default:
+		slog.Warn(
+			"sendq",
+			"user", userID,
+			"msg", msg,
+		)
+		return false
+	}
+}
+
 func writeText(ctx context.Context, c *websocket.Conn, msg string) error {
 	err := c.Write(ctx, websocket.MessageText, []byte(msg))
 	if err != nil {
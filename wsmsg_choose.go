@@ -22,15 +22,9 @@ package main
 
 import (
 	"context"
-	"errors"
-	"log/slog"
 	"strconv"
-	"sync/atomic"
-	"time"
 
 	"github.com/coder/websocket"
-	"github.com/jackc/pgx/v5"
-	"github.com/jackc/pgx/v5/pgconn"
 )
 
 func messageChooseCourse(
@@ -38,10 +32,11 @@ func messageChooseCourse(
 	c *websocket.Conn,
 	mar []string,
 	userID string,
-	userCourseGroups *userCourseGroupsT,
-	userCourseTypes *userCourseTypesT,
+	department string,
+	actor string,
+	connID string,
 ) error {
-	if atomic.LoadUint32(&state) != 2 {
+	if getState() != stateOpen {
 		err := writeText(ctx, c, "E :Course selections are not open")
 		if err != nil {
 			return wrapError(
@@ -52,6 +47,17 @@ func messageChooseCourse(
 		return nil
 	}
 
+	if config.Mode != selectionModeFCFS {
+		err := writeText(ctx, c, "E :Courses are allocated by lottery")
+		if err != nil {
+			return wrapError(
+				errCannotSend,
+				err,
+			)
+		}
+		return nil
+	}
+
 	select {
 	case <-ctx.Done():
 		return wrapError(
@@ -82,8 +88,23 @@ func messageChooseCourse(
 		return errNoSuchCourse
 	}
 
-	if _, ok := (*userCourseGroups)[course.Group]; ok {
-		err := writeText(ctx, c, "R "+mar[1]+" :Group conflict")
+	entry := auditT{
+		UserID:   userID,
+		Actor:    actor,
+		Action:   auditChoose,
+		CourseID: courseID,
+		Conn:     connID,
+	} //exhaustruct:ignore
+	reason, err := chooseCourse(ctx, userID, department, course, entry)
+	if err != nil {
+		return err
+	}
+	if reason != "" {
+		err := recordRejection(ctx, entry, reason)
+		if err != nil {
+			return err
+		}
+		err = writeText(ctx, c, "R "+mar[1]+" :"+reason)
 		if err != nil {
 			return wrapError(
 				errCannotSend,
@@ -93,119 +114,23 @@ func messageChooseCourse(
 		return nil
 	}
 
-	err = func() (returnedError error) {
-		tx, err := db.Begin(ctx)
-		if err != nil {
-			return wrapError(errUnexpectedDBError, err)
-		}
-		defer func() {
-			err := tx.Rollback(ctx)
-			if err != nil && (!errors.Is(err, pgx.ErrTxClosed)) {
-				returnedError = wrapError(errUnexpectedDBError, err)
-				return
-			}
-		}()
-
-		_, err = tx.Exec(
-			ctx,
-			"INSERT INTO choices (seltime, userid, courseid) VALUES ($1, $2, $3)",
-			time.Now().UnixMicro(),
-			userID,
-			courseID,
+	err = writeText(ctx, c, "Y "+mar[1])
+	if err != nil {
+		return wrapError(
+			errCannotSend,
+			err,
 		)
-		if err != nil {
-			var pgErr *pgconn.PgError
-			if errors.As(err, &pgErr) &&
-				pgErr.Code == pgErrUniqueViolation {
-				err2 := writeText(ctx, c, "Y "+mar[1])
-				if err2 != nil {
-					return wrapError(
-						err2,
-						wrapError(errUnexpectedDBError, err),
-					)
-				}
-				return nil
-			}
-			return wrapError(errUnexpectedDBError, err)
-		}
-
-		ok := func() bool {
-			course.SelectedLock.Lock()
-			defer course.SelectedLock.Unlock()
-			/*
-			 * The read here doesn't have to be atomic because the
-			 * lock guarantees that no other goroutine is writing to
-			 * it.
-			 */
-			if course.Selected < course.Max {
-				atomic.AddUint32(&course.Selected, 1)
-				return true
-			}
-			return false
-		}()
-
-		if ok {
-			go func() {
-				defer func() {
-					if e := recover(); e != nil {
-						slog.Error("panic", "arg", e)
-					}
-				}()
-				propagateSelectedUpdate(course)
-			}()
-			err := tx.Commit(ctx)
-			if err != nil {
-				err := course.decrementSelectedAndPropagate(ctx, c)
-				if err != nil {
-					return wrapError(
-						errCannotSend,
-						err,
-					)
-				}
-				return wrapError(errUnexpectedDBError, err)
-			}
-
-			/*
-			 * This would race if message handlers could run
-			 * concurrently for one connection.
-			 */
-			(*userCourseGroups)[course.Group] = struct{}{}
-			(*userCourseTypes)[course.Type]++
-
-			err = writeText(ctx, c, "Y "+mar[1])
-			if err != nil {
-				return wrapError(
-					errCannotSend,
-					err,
-				)
-			}
+	}
 
-			if config.Perf.PropagateImmediate {
-				err = sendSelectedUpdate(ctx, c, courseID)
-				if err != nil {
-					return wrapError(
-						errCannotSend,
-						err,
-					)
-				}
-			}
-		} else {
-			err := tx.Rollback(ctx)
-			if err != nil {
-				return wrapError(errUnexpectedDBError, err)
-			}
-			err = writeText(ctx, c, "R "+mar[1]+" :Full")
-			if err != nil {
-				return wrapError(
-					errCannotSend,
-					err,
-				)
-			}
+	if config.Perf.PropagateImmediate {
+		err = sendSelectedUpdate(ctx, c, courseID)
+		if err != nil {
+			return wrapError(
+				errCannotSend,
+				err,
+			)
 		}
-		return nil
-	}()
-	if err != nil {
-		return err
 	}
+
 	return nil
 }
@@ -22,10 +22,11 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"sync/atomic"
 
 	"github.com/coder/websocket"
+	"github.com/jackc/pgx/v5"
 )
 
 func messageConfirm(
@@ -34,11 +35,12 @@ func messageConfirm(
 	mar []string,
 	userID string,
 	department string,
-	userCourseTypes *userCourseTypesT,
+	actor string,
+	connID string,
 ) error {
 	_ = mar
 
-	if atomic.LoadUint32(&state) != 2 {
+	if getState() != stateOpen && getState() != stateConfirmOnly {
 		err := writeText(ctx, c, "E :Course selections are not open")
 		if err != nil {
 			return wrapError(
@@ -49,6 +51,21 @@ func messageConfirm(
 		return nil
 	}
 
+	/*
+	 * Preferences could not be changed while choices are confirmed, and
+	 * the lottery unconfirms the choices it changes anyway.
+	 */
+	if config.Mode == selectionModeLottery {
+		err := writeText(ctx, c, "E :Choices cannot be confirmed when courses are allocated by lottery")
+		if err != nil {
+			return wrapError(
+				errCannotSend,
+				err,
+			)
+		}
+		return nil
+	}
+
 	select {
 	case <-ctx.Done():
 		return wrapError(
@@ -58,32 +75,112 @@ func messageConfirm(
 	default:
 	}
 
-	for courseType := range courseTypes {
-		minimum, err := getCourseTypeMinimumForYearGroup(department, courseType)
+	entry := auditT{
+		UserID: userID,
+		Actor:  actor,
+		Action: auditConfirm,
+		Conn:   connID,
+	} //exhaustruct:ignore
+
+	/*
+	 * The user's row is locked while their choices are checked, so that
+	 * they cannot be changed between the check and the confirmation.
+	 */
+	reason, err := func() (retReason string, retErr error) {
+		tx, err := db.Begin(ctx)
 		if err != nil {
-			return wrapError(errInvalidYearGroupOrCourseType, err)
+			return "", wrapError(errUnexpectedDBError, err)
 		}
-		if (*userCourseTypes)[courseType] < minimum {
-			return writeText(
-				ctx,
-				c,
-				fmt.Sprintf(
-					"RC :Cannot confirm choices: You chose %d out of required %d of type %s",
-					(*userCourseTypes)[courseType],
-					minimum,
+		defer func() {
+			err := tx.Rollback(ctx)
+			if err != nil && (!errors.Is(err, pgx.ErrTxClosed)) {
+				retErr = wrapError(errUnexpectedDBError, err)
+				return
+			}
+		}()
+
+		_, err = lockUser(ctx, tx, userID)
+		if err != nil {
+			return "", err
+		}
+
+		var userCourseGroups userCourseGroupsT = make(map[string]struct{})
+		var userCourseTypes userCourseTypesT = make(map[string]int)
+		err = populateUserCourseTypesAndGroups(
+			ctx,
+			tx,
+			&userCourseTypes,
+			&userCourseGroups,
+			userID,
+		)
+		if err != nil {
+			return "", err
+		}
+
+		for _, courseType := range getCourseTypeHandles() {
+			requirement, err := getCourseTypeRequirementForYearGroup(department, courseType)
+			if err != nil {
+				return "", wrapError(errInvalidYearGroupOrCourseType, err)
+			}
+			if userCourseTypes[courseType] < requirement.Min {
+				return fmt.Sprintf(
+					"You chose %d out of required %d of type %s",
+					userCourseTypes[courseType],
+					requirement.Min,
 					courseType,
-				),
-			)
+				), nil
+			}
+			if requirement.Max >= 0 && userCourseTypes[courseType] > requirement.Max {
+				return fmt.Sprintf(
+					"You chose %d out of at most %d of type %s",
+					userCourseTypes[courseType],
+					requirement.Max,
+					courseType,
+				), nil
+			}
 		}
-	}
 
-	_, err := db.Exec(
-		ctx,
-		"UPDATE users SET confirmed = true WHERE id = $1",
-		userID,
-	)
+		maxChoices, err := getMaxChoicesForYearGroup(department)
+		if err != nil {
+			return "", wrapError(errInvalidYearGroupOrCourseType, err)
+		}
+		if maxChoices >= 0 && userCourseTypes.total() > maxChoices {
+			return fmt.Sprintf(
+				"You chose %d courses out of at most %d",
+				userCourseTypes.total(),
+				maxChoices,
+			), nil
+		}
+
+		_, err = tx.Exec(
+			ctx,
+			"UPDATE users SET confirmed = true WHERE id = $1",
+			userID,
+		)
+		if err != nil {
+			return "", wrapError(errUnexpectedDBError, err)
+		}
+		entry.Outcome = auditAccepted
+		err = recordAudit(ctx, tx, entry)
+		if err != nil {
+			return "", err
+		}
+		err = tx.Commit(ctx)
+		if err != nil {
+			return "", wrapError(errUnexpectedDBError, err)
+		}
+		return "", nil
+	}()
 	if err != nil {
-		return wrapError(errUnexpectedDBError, err)
+		return err
+	}
+
+	if reason != "" {
+		err := recordRejection(ctx, entry, reason)
+		if err != nil {
+			return err
+		}
+		return writeText(ctx, c, "RC :Cannot confirm choices: "+reason)
 	}
 
 	return writeText(
@@ -23,7 +23,6 @@ package main
 import (
 	"context"
 	"strings"
-	"sync/atomic"
 
 	"github.com/coder/websocket"
 	"github.com/jackc/pgx/v5"
@@ -59,11 +58,9 @@ func messageHello(
 		return wrapError(errUnexpectedDBError, err)
 	}
 
-	if atomic.LoadUint32(&state) == 2 {
-		err = writeText(ctx, c, "START")
-		if err != nil {
-			return wrapError(errCannotSend, err)
-		}
+	err = writeText(ctx, c, "S "+getState().String())
+	if err != nil {
+		return wrapError(errCannotSend, err)
 	}
 
 	confirmed, err := getConfirmedStatus(ctx, userID)
@@ -82,6 +79,62 @@ func messageHello(
 		}
 	}
 
+	rows, err = db.Query(
+		ctx,
+		"SELECT courseid FROM waitlist WHERE userid = $1",
+		userID,
+	)
+	if err != nil {
+		return wrapError(errUnexpectedDBError, err)
+	}
+	waitingCourseIDs, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return wrapError(errUnexpectedDBError, err)
+	}
+
+	err = writeText(ctx, c, "HW :"+strings.Join(waitingCourseIDs, ","))
+	if err != nil {
+		return wrapError(errCannotSend, err)
+	}
+
+	if config.Mode == selectionModeLottery {
+		rows, err = db.Query(
+			ctx,
+			"SELECT c.cgroup, p.courseid FROM preferences p JOIN courses c ON c.id = p.courseid WHERE p.userid = $1 ORDER BY p.rank",
+			userID,
+		)
+		if err != nil {
+			return wrapError(errUnexpectedDBError, err)
+		}
+		type preferenceT struct {
+			Group    string
+			CourseID string
+		}
+		preferences, err := pgx.CollectRows(rows, pgx.RowToStructByPos[preferenceT])
+		if err != nil {
+			return wrapError(errUnexpectedDBError, err)
+		}
+		preferencesByGroup := make(map[string][]string)
+		for _, p := range preferences {
+			preferencesByGroup[p.Group] = append(preferencesByGroup[p.Group], p.CourseID)
+		}
+		for group, courseIDs := range preferencesByGroup {
+			err = writeText(ctx, c, "P "+group+" :"+strings.Join(courseIDs, ","))
+			if err != nil {
+				return wrapError(errCannotSend, err)
+			}
+		}
+	}
+
+	scheduleMessage, err := getNextScheduleMessage(ctx)
+	if err != nil {
+		return err
+	}
+	err = writeText(ctx, c, scheduleMessage)
+	if err != nil {
+		return wrapError(errCannotSend, err)
+	}
+
 	err = writeText(ctx, c, "HI :"+strings.Join(courseIDs, ","))
 	if err != nil {
 		return wrapError(errCannotSend, err)
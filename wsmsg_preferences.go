@@ -0,0 +1,210 @@
+/*
+ * Handle the "P" message for ranking courses in a course group
+ *
+ * Copyright (C) 2024  Runxi Yu <https://runxiyu.org>
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/coder/websocket"
+	"github.com/jackc/pgx/v5"
+)
+
+/*
+ * The message is in the form of "P <group> :<course IDs>", where the course
+ * IDs are separated by commas and ordered from the most preferred. The
+ * preferences replace any previous preferences in the same course group.
+ */
+func messagePreferences(
+	ctx context.Context,
+	c *websocket.Conn,
+	mar []string,
+	userID string,
+	department string,
+	actor string,
+	connID string,
+) error {
+	if getState() != stateOpen {
+		err := writeText(ctx, c, "E :Course selections are not open")
+		if err != nil {
+			return wrapError(
+				errCannotSend,
+				err,
+			)
+		}
+		return nil
+	}
+
+	if config.Mode != selectionModeLottery {
+		err := writeText(ctx, c, "E :Courses are not allocated by lottery")
+		if err != nil {
+			return wrapError(
+				errCannotSend,
+				err,
+			)
+		}
+		return nil
+	}
+
+	select {
+	case <-ctx.Done():
+		return wrapError(
+			errContextCanceled,
+			ctx.Err(),
+		)
+	default:
+	}
+
+	if len(mar) != 3 {
+		return errBadNumberOfArguments
+	}
+	group := mar[1]
+	if !checkCourseGroup(group) {
+		return wrapAny(errInvalidCourseGroup, group)
+	}
+
+	var courseIDs []int
+	if mar[2] != "" {
+		for _, s := range strings.Split(mar[2], ",") {
+			_courseID, err := strconv.ParseInt(s, 10, strconv.IntSize)
+			if err != nil {
+				return errNoSuchCourse
+			}
+			courseID := int(_courseID)
+			_course, ok := courses.Load(courseID)
+			if !ok {
+				return errNoSuchCourse
+			}
+			course, ok := _course.(*courseT)
+			if !ok {
+				panic("courses map has non-\"*courseT\" items")
+			}
+			if course == nil {
+				return errNoSuchCourse
+			}
+			if courseGroup := course.Info().Group; courseGroup != group {
+				return wrapAny(errInvalidCourseGroup, courseGroup)
+			}
+			for _, other := range courseIDs {
+				if other == courseID {
+					return wrapAny(errDuplicatePreference, courseID)
+				}
+			}
+			if !course.Info().EligibleFor(department) {
+				err := writeText(ctx, c, "RP "+group+" :Not eligible")
+				if err != nil {
+					return wrapError(
+						errCannotSend,
+						err,
+					)
+				}
+				return nil
+			}
+			courseIDs = append(courseIDs, courseID)
+		}
+	}
+
+	reason, err := func() (retReason string, retErr error) {
+		tx, err := db.Begin(ctx)
+		if err != nil {
+			return "", wrapError(errUnexpectedDBError, err)
+		}
+		defer func() {
+			err := tx.Rollback(ctx)
+			if err != nil && (!errors.Is(err, pgx.ErrTxClosed)) {
+				retErr = wrapError(errUnexpectedDBError, err)
+				return
+			}
+		}()
+
+		confirmed, err := lockUser(ctx, tx, userID)
+		if err != nil {
+			return "", err
+		}
+		if confirmed {
+			return "Confirmed", nil
+		}
+
+		_, err = tx.Exec(
+			ctx,
+			"DELETE FROM preferences WHERE userid = $1 AND courseid IN (SELECT id FROM courses WHERE cgroup = $2)",
+			userID,
+			group,
+		)
+		if err != nil {
+			return "", wrapError(errUnexpectedDBError, err)
+		}
+		err = recordAudit(ctx, tx, auditT{
+			UserID:  userID,
+			Actor:   actor,
+			Action:  auditPreferences,
+			Outcome: auditAccepted,
+			Conn:    connID,
+			Note:    group + " " + mar[2],
+		}) //exhaustruct:ignore
+		if err != nil {
+			return "", err
+		}
+		for i, courseID := range courseIDs {
+			_, err = tx.Exec(
+				ctx,
+				"INSERT INTO preferences (rank, userid, courseid) VALUES ($1, $2, $3)",
+				i+1,
+				userID,
+				courseID,
+			)
+			if err != nil {
+				return "", wrapError(errUnexpectedDBError, err)
+			}
+		}
+
+		err = tx.Commit(ctx)
+		if err != nil {
+			return "", wrapError(errUnexpectedDBError, err)
+		}
+		return "", nil
+	}()
+	if err != nil {
+		return err
+	}
+	if reason != "" {
+		err := writeText(ctx, c, "RP "+group+" :"+reason)
+		if err != nil {
+			return wrapError(
+				errCannotSend,
+				err,
+			)
+		}
+		return nil
+	}
+
+	err = writeText(ctx, c, "P "+group+" :"+mar[2])
+	if err != nil {
+		return wrapError(
+			errCannotSend,
+			err,
+		)
+	}
+
+	return nil
+}
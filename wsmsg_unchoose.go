@@ -23,7 +23,6 @@ package main
 import (
 	"context"
 	"strconv"
-	"sync/atomic"
 
 	"github.com/coder/websocket"
 )
@@ -33,10 +32,10 @@ func messageUnchooseCourse(
 	c *websocket.Conn,
 	mar []string,
 	userID string,
-	userCourseGroups *userCourseGroupsT,
-	userCourseTypes *userCourseTypesT,
+	actor string,
+	connID string,
 ) error {
-	if atomic.LoadUint32(&state) != 2 {
+	if getState() != stateOpen {
 		err := writeText(ctx, c, "E :Course selections are not open")
 		if err != nil {
 			return wrapError(
@@ -47,6 +46,17 @@ func messageUnchooseCourse(
 		return nil
 	}
 
+	if config.Mode != selectionModeFCFS {
+		err := writeText(ctx, c, "E :Courses are allocated by lottery")
+		if err != nil {
+			return wrapError(
+				errCannotSend,
+				err,
+			)
+		}
+		return nil
+	}
+
 	select {
 	case <-ctx.Done():
 		return wrapError(
@@ -77,42 +87,47 @@ func messageUnchooseCourse(
 		return errNoSuchCourse
 	}
 
-	ct, err := db.Exec(
-		ctx,
-		"DELETE FROM choices WHERE userid = $1 AND courseid = $2",
-		userID,
-		courseID,
-	)
+	entry := auditT{
+		UserID:   userID,
+		Actor:    actor,
+		Action:   auditUnchoose,
+		CourseID: courseID,
+		Conn:     connID,
+	} //exhaustruct:ignore
+	reason, err := unchooseCourse(ctx, userID, course, entry)
 	if err != nil {
-		return wrapError(errUnexpectedDBError, err)
+		return err
+	}
+	if reason != "" {
+		err := recordRejection(ctx, entry, reason)
+		if err != nil {
+			return err
+		}
 	}
 
-	if ct.RowsAffected() != 0 {
-		err := course.decrementSelectedAndPropagate(ctx, c)
+	/*
+	 * Unchoosing a course that is not chosen is harmless, so the client
+	 * is told that it is not chosen.
+	 */
+	switch reason {
+	case "":
+		err := sendSelectedUpdate(ctx, c, courseID)
 		if err != nil {
 			return wrapError(
 				errCannotSend,
 				err,
 			)
 		}
-
-		_course, ok := courses.Load(courseID)
-		if !ok {
-			return errNoSuchCourse
-		}
-		course, ok := _course.(*courseT)
-		if !ok {
-			panic("courses map has non-\"*courseT\" items")
-		}
-		if course == nil {
-			return errNoSuchCourse
-		}
-
-		if _, ok := (*userCourseGroups)[course.Group]; !ok {
-			return errCourseGroupHandlingError
+	case "Not chosen":
+	default:
+		err := writeText(ctx, c, "RN "+mar[1]+" :"+reason)
+		if err != nil {
+			return wrapError(
+				errCannotSend,
+				err,
+			)
 		}
-		delete(*userCourseGroups, course.Group)
-		(*userCourseTypes)[course.Type]--
+		return nil
 	}
 
 	err = writeText(ctx, c, "N "+mar[1])
@@ -22,7 +22,6 @@ package main
 
 import (
 	"context"
-	"sync/atomic"
 
 	"github.com/coder/websocket"
 )
@@ -32,10 +31,12 @@ func messageUnconfirm(
 	c *websocket.Conn,
 	mar []string,
 	userID string,
+	actor string,
+	connID string,
 ) error {
 	_ = mar
 
-	if atomic.LoadUint32(&state) != 2 {
+	if getState() != stateOpen && getState() != stateConfirmOnly {
 		err := writeText(ctx, c, "E :Course selections are not open")
 		if err != nil {
 			return wrapError(
@@ -46,6 +47,18 @@ func messageUnconfirm(
 		return nil
 	}
 
+	/* Students cannot confirm in lottery mode, so there is nothing to undo */
+	if config.Mode == selectionModeLottery {
+		err := writeText(ctx, c, "E :Choices cannot be unconfirmed when courses are allocated by lottery")
+		if err != nil {
+			return wrapError(
+				errCannotSend,
+				err,
+			)
+		}
+		return nil
+	}
+
 	select {
 	case <-ctx.Done():
 		return wrapError(
@@ -55,13 +68,19 @@ func messageUnconfirm(
 	default:
 	}
 
-	_, err := db.Exec(
+	err := execAudited(
 		ctx,
+		auditT{
+			UserID: userID,
+			Actor:  actor,
+			Action: auditUnconfirm,
+			Conn:   connID,
+		}, //exhaustruct:ignore
 		"UPDATE users SET confirmed = false WHERE id = $1",
 		userID,
 	)
 	if err != nil {
-		return wrapError(errUnexpectedDBError, err)
+		return err
 	}
 
 	return writeText(
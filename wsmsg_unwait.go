@@ -0,0 +1,104 @@
+/*
+ * Handle the "NW" message for leaving the waitlist of a course
+ *
+ * Copyright (C) 2024  Runxi Yu <https://runxiyu.org>
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/coder/websocket"
+)
+
+func messageUnwait(
+	ctx context.Context,
+	c *websocket.Conn,
+	mar []string,
+	userID string,
+	actor string,
+	connID string,
+) error {
+	if getState() != stateOpen {
+		err := writeText(ctx, c, "E :Course selections are not open")
+		if err != nil {
+			return wrapError(
+				errCannotSend,
+				err,
+			)
+		}
+		return nil
+	}
+
+	if config.Mode != selectionModeFCFS {
+		err := writeText(ctx, c, "E :Courses are allocated by lottery")
+		if err != nil {
+			return wrapError(
+				errCannotSend,
+				err,
+			)
+		}
+		return nil
+	}
+
+	select {
+	case <-ctx.Done():
+		return wrapError(
+			errContextCanceled,
+			ctx.Err(),
+		)
+	default:
+	}
+
+	if len(mar) != 2 {
+		return errBadNumberOfArguments
+	}
+	_courseID, err := strconv.ParseInt(mar[1], 10, strconv.IntSize)
+	if err != nil {
+		return errNoSuchCourse
+	}
+	courseID := int(_courseID)
+
+	err = execAudited(
+		ctx,
+		auditT{
+			UserID:   userID,
+			Actor:    actor,
+			Action:   auditUnwait,
+			CourseID: courseID,
+			Conn:     connID,
+		}, //exhaustruct:ignore
+		"DELETE FROM waitlist WHERE userid = $1 AND courseid = $2",
+		userID,
+		courseID,
+	)
+	if err != nil {
+		return err
+	}
+
+	err = writeText(ctx, c, "NW "+mar[1])
+	if err != nil {
+		return wrapError(
+			errCannotSend,
+			err,
+		)
+	}
+
+	return nil
+}
@@ -0,0 +1,171 @@
+/*
+ * Handle the "W" message for joining the waitlist of a course
+ *
+ * Copyright (C) 2024  Runxi Yu <https://runxiyu.org>
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+func messageWait(
+	ctx context.Context,
+	c *websocket.Conn,
+	mar []string,
+	userID string,
+	department string,
+	actor string,
+	connID string,
+) error {
+	if getState() != stateOpen {
+		err := writeText(ctx, c, "E :Course selections are not open")
+		if err != nil {
+			return wrapError(
+				errCannotSend,
+				err,
+			)
+		}
+		return nil
+	}
+
+	if config.Mode != selectionModeFCFS {
+		err := writeText(ctx, c, "E :Courses are allocated by lottery")
+		if err != nil {
+			return wrapError(
+				errCannotSend,
+				err,
+			)
+		}
+		return nil
+	}
+
+	select {
+	case <-ctx.Done():
+		return wrapError(
+			errContextCanceled,
+			ctx.Err(),
+		)
+	default:
+	}
+
+	if len(mar) != 2 {
+		return errBadNumberOfArguments
+	}
+	_courseID, err := strconv.ParseInt(mar[1], 10, strconv.IntSize)
+	if err != nil {
+		return errNoSuchCourse
+	}
+	courseID := int(_courseID)
+
+	_course, ok := courses.Load(courseID)
+	if !ok {
+		return errNoSuchCourse
+	}
+	course, ok := _course.(*courseT)
+	if !ok {
+		panic("courses map has non-\"*courseT\" items")
+	}
+	if course == nil {
+		return errNoSuchCourse
+	}
+
+	var reason string
+	var alreadyChosen bool
+	err = db.QueryRow(
+		ctx,
+		"SELECT EXISTS (SELECT 1 FROM choices WHERE userid = $1 AND courseid = $2)",
+		userID,
+		courseID,
+	).Scan(&alreadyChosen)
+	if err != nil {
+		return wrapError(errUnexpectedDBError, err)
+	}
+
+	confirmed, err := getConfirmedStatus(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case !course.Info().EligibleFor(department):
+		reason = "Not eligible"
+	case alreadyChosen:
+		reason = "Already chosen"
+	case confirmed:
+		reason = "Confirmed"
+	case atomic.LoadUint32(&course.Selected) < atomic.LoadUint32(&course.Max):
+		/*
+		 * A seat could still be freed between this check and the
+		 * insertion below, in which case the student stays on the
+		 * waitlist until the next seat is freed. They would see the
+		 * seat being available anyway.
+		 */
+		reason = "Not full"
+	}
+
+	entry := auditT{
+		UserID:   userID,
+		Actor:    actor,
+		Action:   auditWait,
+		CourseID: courseID,
+		Conn:     connID,
+	} //exhaustruct:ignore
+
+	if reason != "" {
+		err := recordRejection(ctx, entry, reason)
+		if err != nil {
+			return err
+		}
+		err = writeText(ctx, c, "RW "+mar[1]+" :"+reason)
+		if err != nil {
+			return wrapError(
+				errCannotSend,
+				err,
+			)
+		}
+		return nil
+	}
+
+	err = execAudited(
+		ctx,
+		entry,
+		"INSERT INTO waitlist (jointime, userid, courseid) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING",
+		time.Now().UnixMicro(),
+		userID,
+		courseID,
+	)
+	if err != nil {
+		return err
+	}
+
+	err = writeText(ctx, c, "W "+mar[1])
+	if err != nil {
+		return wrapError(
+			errCannotSend,
+			err,
+		)
+	}
+
+	return nil
+}